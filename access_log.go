@@ -0,0 +1,226 @@
+package hypro
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// AccessLogCombined is the Combined Log Format followed by the tunnel
+	// host, the tunnel wait and the upstream duration in seconds
+	AccessLogCombined = "combined"
+	// AccessLogJSON is a JSON object per line
+	AccessLogJSON = "json"
+)
+
+// AccessLog writes a line for every request of the public http listeners
+type AccessLog struct {
+	// Format is AccessLogCombined or AccessLogJSON, combined if empty
+	Format string
+	// Writer is where the lines go, e.g. a LogFile
+	Writer io.Writer
+
+	mu sync.Mutex // serializes the writes of the lines
+}
+
+// accessLogEntry is a request of the access log
+type accessLogEntry struct {
+	Time       time.Time `json:"time"`
+	Host       string    `json:"host"`
+	RemoteAddr string    `json:"remote_addr"`
+	Method     string    `json:"method"`
+	URI        string    `json:"uri"`
+	Proto      string    `json:"proto"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	Referer    string    `json:"referer"`
+	UserAgent  string    `json:"user_agent"`
+	// the durations in milliseconds, upstream is the time after the
+	// tunnel connection is got, and tunnel wait the time waiting for it
+	Duration   float64 `json:"duration_ms"`
+	Upstream   float64 `json:"upstream_ms"`
+	TunnelWait float64 `json:"tunnel_wait_ms"`
+}
+
+// Handler returns the handler logging the requests served by h
+func (l *AccessLog) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		var mu sync.Mutex // the trace could be called by the goroutines of the transport
+		var getConn, gotConn time.Time
+		trace := &httptrace.ClientTrace{
+			GetConn: func(string) {
+				mu.Lock()
+				defer mu.Unlock()
+				if getConn.IsZero() {
+					getConn = time.Now()
+				}
+			},
+			GotConn: func(httptrace.GotConnInfo) {
+				mu.Lock()
+				defer mu.Unlock()
+				if gotConn.IsZero() {
+					gotConn = time.Now()
+				}
+			},
+		}
+		rw := &accessLogResponseWriter{ResponseWriter: w}
+		h.ServeHTTP(rw, r.WithContext(httptrace.WithClientTrace(r.Context(), trace)))
+		end := time.Now()
+
+		remoteAddr := r.RemoteAddr
+		if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+			remoteAddr = host
+		}
+		e := &accessLogEntry{
+			Time:       start,
+			Host:       r.Host,
+			RemoteAddr: remoteAddr,
+			Method:     r.Method,
+			URI:        r.RequestURI,
+			Proto:      r.Proto,
+			Status:     rw.status,
+			Bytes:      rw.bytes,
+			Referer:    r.Referer(),
+			UserAgent:  r.UserAgent(),
+			Duration:   millis(end.Sub(start)),
+		}
+		if e.Status == 0 {
+			e.Status = http.StatusOK
+		}
+		mu.Lock()
+		switch {
+		case !gotConn.IsZero():
+			e.TunnelWait = millis(gotConn.Sub(getConn))
+			e.Upstream = millis(end.Sub(gotConn))
+		case !getConn.IsZero():
+			// no tunnel connection of the host
+			e.TunnelWait = millis(end.Sub(getConn))
+		}
+		mu.Unlock()
+		l.write(e)
+	})
+}
+
+func (l *AccessLog) write(e *accessLogEntry) {
+	var buf bytes.Buffer
+	if l.Format == AccessLogJSON {
+		json.NewEncoder(&buf).Encode(e)
+	} else {
+		fmt.Fprintf(&buf, "%s - - [%s] %s %d %s %s %s %s %.3f %.3f\n",
+			e.RemoteAddr,
+			e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			strconv.Quote(e.Method+" "+e.URI+" "+e.Proto),
+			e.Status,
+			combinedBytes(e.Bytes),
+			combinedQuote(e.Referer),
+			combinedQuote(e.UserAgent),
+			combinedQuote(e.Host),
+			e.TunnelWait/1000,
+			e.Upstream/1000,
+		)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.Writer.Write(buf.Bytes())
+}
+
+func combinedBytes(n int64) string {
+	if n == 0 {
+		return "-"
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+func combinedQuote(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	return strconv.Quote(s)
+}
+
+// accessLogResponseWriter records the status and the size of the response,
+// the Flush and Hijack of http.ResponseController go to the underlying writer
+type accessLogResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessLogResponseWriter) WriteHeader(code int) {
+	if w.status == 0 && (code >= 200 || code == http.StatusSwitchingProtocols) {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessLogResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *accessLogResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// LogFile is a log file appended to, which could be reopened after it is
+// rotated, e.g. by logrotate
+type LogFile struct {
+	Path string
+
+	mu sync.Mutex // protects f
+	f  *os.File
+}
+
+// OpenLogFile opens the file at path to append
+func OpenLogFile(path string) (*LogFile, error) {
+	f := &LogFile{Path: path}
+	if err := f.Reopen(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reopen closes the file and opens the Path again
+func (f *LogFile) Reopen() error {
+	file, err := os.OpenFile(f.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "could not open log file %s", f.Path)
+	}
+	f.mu.Lock()
+	old := f.f
+	f.f = file
+	f.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+func (f *LogFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.f.Write(p)
+}
+
+// Close closes the file
+func (f *LogFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.f.Close()
+}
@@ -0,0 +1,111 @@
+package hypro
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLog_Handler(t *testing.T) {
+	// proxied waits for the tunnel connection and the upstream like the
+	// transport of the reverse proxy
+	proxied := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		trace := httptrace.ContextClientTrace(r.Context())
+		trace.GetConn(r.Host)
+		time.Sleep(20 * time.Millisecond)
+		trace.GotConn(httptrace.GotConnInfo{})
+		time.Sleep(10 * time.Millisecond)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	})
+	notFound := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		httptrace.ContextClientTrace(r.Context()).GetConn(r.Host)
+		w.WriteHeader(http.StatusBadGateway)
+	})
+
+	tests := []struct {
+		name    string
+		format  string
+		handler http.Handler
+		want    string
+	}{
+		{
+			"Combined",
+			AccessLogCombined,
+			proxied,
+			`^192\.0\.2\.1 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "POST /hook\?a=1 HTTP/1\.1" 201 5 "https://example\.com/" "test-agent" "app\.example\.com" \d+\.\d{3} \d+\.\d{3}\n$`,
+		},
+		{
+			"CombinedNotFound",
+			"",
+			notFound,
+			`^192\.0\.2\.1 - - \[.+\] "POST /hook\?a=1 HTTP/1\.1" 502 - "https://example\.com/" "test-agent" "app\.example\.com" \d+\.\d{3} 0\.000\n$`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf strings.Builder
+			l := &AccessLog{Format: tt.format, Writer: &buf}
+			r := httptest.NewRequest("POST", "/hook?a=1", nil)
+			r.Host = "app.example.com"
+			r.Header.Set("Referer", "https://example.com/")
+			r.Header.Set("User-Agent", "test-agent")
+			l.Handler(tt.handler).ServeHTTP(httptest.NewRecorder(), r)
+			if !regexp.MustCompile(tt.want).MatchString(buf.String()) {
+				t.Errorf("AccessLog = %q, want %s", buf.String(), tt.want)
+			}
+		})
+	}
+
+	t.Run("JSON", func(t *testing.T) {
+		var buf strings.Builder
+		l := &AccessLog{Format: AccessLogJSON, Writer: &buf}
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Host = "app.example.com"
+		l.Handler(proxied).ServeHTTP(httptest.NewRecorder(), r)
+
+		var e accessLogEntry
+		if err := json.Unmarshal([]byte(buf.String()), &e); err != nil {
+			t.Fatalf("AccessLog = %q: %v", buf.String(), err)
+		}
+		if e.Host != "app.example.com" || e.RemoteAddr != "192.0.2.1" || e.Method != "GET" || e.URI != "/" || e.Status != 201 || e.Bytes != 5 {
+			t.Errorf("AccessLog = %+v", e)
+		}
+		if e.TunnelWait < 20 || e.Upstream < 10 || e.Duration < e.TunnelWait+e.Upstream {
+			t.Errorf("AccessLog durations = %v, tunnel wait %v, upstream %v", e.Duration, e.TunnelWait, e.Upstream)
+		}
+	})
+}
+
+func TestLogFile_Reopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := OpenLogFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	f.Write([]byte("a\n"))
+	// rotated
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("b\n"))
+	if err := f.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("c\n"))
+
+	for file, want := range map[string]string{path + ".1": "a\nb\n", path: "c\n"} {
+		if b, _ := os.ReadFile(file); string(b) != want {
+			t.Errorf("%s = %q, want %q", filepath.Base(file), b, want)
+		}
+	}
+}
@@ -0,0 +1,375 @@
+package hypro
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	// acmeRenewBefore renews the wildcard certificate before it expires
+	acmeRenewBefore = 30 * 24 * time.Hour
+	// acmeCheckInterval is how often the wildcard certificate is checked for renewal
+	acmeCheckInterval = 12 * time.Hour
+	// acmeRetryMin and acmeRetryMax bound the backoff after a failed issuance
+	acmeRetryMin = time.Minute
+	acmeRetryMax = time.Hour
+
+	wildcardAccountKey = "wildcard_account+key"
+)
+
+// ACMEConfig obtains and renews the https certificates of the base domain and
+// the registered tunnel domains from an ACME CA, e.g. Let's Encrypt
+type ACMEConfig struct {
+	// DirectoryURL is the ACME directory of the CA, defaults to Let's Encrypt
+	DirectoryURL string
+
+	// Email is the contact of the ACME account, optional
+	Email string
+
+	// CacheDir stores the account keys and the certificates
+	CacheDir string
+
+	// BaseDomain is the domain of the server, e.g. example.com
+	BaseDomain string
+
+	// DNSHook solves dns-01 challenges to obtain the wildcard certificate of
+	// the BaseDomain. Without it every domain is obtained with http-01
+	// on the http listener
+	DNSHook DNSHook
+}
+
+// DNSHook publishes the TXT records of dns-01 challenges
+type DNSHook interface {
+	// Present creates the TXT record fqdn with the value
+	Present(ctx context.Context, fqdn, value string) error
+	// CleanUp removes the TXT record created by Present
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
+// CommandDNSHook is a DNSHook running the command with the arguments
+// "present" or "cleanup", the record name and the value
+type CommandDNSHook string
+
+// Present runs the command with present
+func (h CommandDNSHook) Present(ctx context.Context, fqdn, value string) error {
+	return h.run(ctx, "present", fqdn, value)
+}
+
+// CleanUp runs the command with cleanup
+func (h CommandDNSHook) CleanUp(ctx context.Context, fqdn, value string) error {
+	return h.run(ctx, "cleanup", fqdn, value)
+}
+
+func (h CommandDNSHook) run(ctx context.Context, action, fqdn, value string) error {
+	out, err := exec.CommandContext(ctx, string(h), action, fqdn, value).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "dns hook %s %s: %s", action, fqdn, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// acmeManager issues the certificates with autocert, and the wildcard
+// certificate with the dns hook
+type acmeManager struct {
+	config  *ACMEConfig
+	manager *autocert.Manager
+	cache   autocert.Cache
+
+	logger *slog.Logger
+
+	mu       sync.RWMutex // protects wildcard
+	wildcard *tls.Certificate
+}
+
+// newACMEManager returns the acme manager allowing the base domain and
+// the domains registered at the server
+func (s *Server) newACMEManager() (*acmeManager, error) {
+	config := s.ACME
+	if config.CacheDir == "" {
+		return nil, errors.New("acme cache dir could not be empty")
+	}
+	if config.BaseDomain == "" {
+		return nil, errors.New("acme base domain could not be empty")
+	}
+	cache := autocert.DirCache(config.CacheDir)
+	return &acmeManager{
+		config: config,
+		cache:  cache,
+		logger: s.logger(),
+		manager: &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      cache,
+			Email:      config.Email,
+			HostPolicy: s.acmeHostPolicy,
+			Client:     &acme.Client{DirectoryURL: config.DirectoryURL},
+		},
+	}, nil
+}
+
+// acmeHostPolicy allows the base domain and the registered domains
+func (s *Server) acmeHostPolicy(ctx context.Context, host string) error {
+	host = strings.ToLower(host)
+	if host == strings.ToLower(s.ACME.BaseDomain) {
+		return nil
+	}
+	s.mu.RLock()
+	_, ok := s.users[host]
+	s.mu.RUnlock()
+	if !ok {
+		return errors.Errorf("acme: host %s is not registered", host)
+	}
+	return nil
+}
+
+// HTTPHandler serves the http-01 challenges, and the other requests with fallback
+func (m *acmeManager) HTTPHandler(fallback http.Handler) http.Handler {
+	return m.manager.HTTPHandler(fallback)
+}
+
+// GetCertificate returns the wildcard certificate if it covers the server
+// name, or the certificate of the server name from autocert
+func (m *acmeManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	wildcard := m.wildcard
+	m.mu.RUnlock()
+
+	name := strings.ToLower(hello.ServerName)
+	if wildcard != nil {
+		for _, n := range certNames(wildcard.Leaf) {
+			if n == name || matchDomain(n, name) {
+				return wildcard, nil
+			}
+		}
+	}
+	return m.manager.GetCertificate(hello)
+}
+
+// keepWildcard obtains the wildcard certificate and renews it until done
+func (m *acmeManager) keepWildcard(done <-chan struct{}) {
+	if m.config.DNSHook == nil {
+		return
+	}
+	failures := 0
+	for {
+		wait := acmeCheckInterval
+		if err := m.renewWildcard(context.Background()); err != nil {
+			failures++
+			wait = acmeRetryDelay(failures)
+			m.logger.Error("could not obtain wildcard certificate", "err", err, "retry_in", wait)
+		} else {
+			failures = 0
+		}
+		select {
+		case <-time.After(wait):
+		case <-done:
+			return
+		}
+	}
+}
+
+// acmeRetryDelay doubles the wait after each failed issuance, from
+// acmeRetryMin up to acmeRetryMax
+func acmeRetryDelay(failures int) time.Duration {
+	d := acmeRetryMin
+	for i := 1; i < failures && d < acmeRetryMax; i++ {
+		d *= 2
+	}
+	if d > acmeRetryMax {
+		d = acmeRetryMax
+	}
+	return d
+}
+
+// renewWildcard loads the cached wildcard certificate, and obtains a new one
+// if it is missing or about to expire
+func (m *acmeManager) renewWildcard(ctx context.Context) error {
+	names := []string{"*." + m.config.BaseDomain, m.config.BaseDomain}
+	cacheKey := "wildcard+" + m.config.BaseDomain
+
+	cert, err := m.loadCertificate(ctx, cacheKey)
+	if err != nil && err != autocert.ErrCacheMiss {
+		m.logger.Warn("could not load cached wildcard certificate", "err", err)
+	}
+	if cert == nil || time.Until(cert.Leaf.NotAfter) < acmeRenewBefore {
+		m.logger.Info("obtaining wildcard certificate", "names", names)
+		if cert, err = m.obtain(ctx, names); err != nil {
+			return err
+		}
+		if err := m.storeCertificate(ctx, cacheKey, cert); err != nil {
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	m.wildcard = cert
+	m.mu.Unlock()
+	return nil
+}
+
+// obtain orders the certificate of the names solving dns-01 challenges
+func (m *acmeManager) obtain(ctx context.Context, names []string) (*tls.Certificate, error) {
+	accountKey, err := m.accountKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	client := &acme.Client{Key: accountKey, DirectoryURL: m.config.DirectoryURL}
+
+	account := &acme.Account{}
+	if m.config.Email != "" {
+		account.Contact = []string{"mailto:" + m.config.Email}
+	}
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && err != acme.ErrAccountAlreadyExists {
+		return nil, errors.Wrap(err, "could not register acme account")
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(names...))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not order certificate")
+	}
+	for _, url := range order.AuthzURLs {
+		if err := m.authorize(ctx, client, url); err != nil {
+			return nil, err
+		}
+	}
+	if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, errors.Wrap(err, "could not wait order")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: names}, key)
+	if err != nil {
+		return nil, err
+	}
+	der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not finalize order")
+	}
+	leaf, err := x509.ParseCertificate(der[0])
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: der, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// authorize solves the dns-01 challenge of the authorization
+func (m *acmeManager) authorize(ctx context.Context, client *acme.Client, url string) error {
+	z, err := client.GetAuthorization(ctx, url)
+	if err != nil {
+		return errors.Wrap(err, "could not get authorization")
+	}
+	if z.Status == acme.StatusValid {
+		return nil
+	}
+
+	var challenge *acme.Challenge
+	for _, c := range z.Challenges {
+		if c.Type == "dns-01" {
+			challenge = c
+			break
+		}
+	}
+	if challenge == nil {
+		return errors.Errorf("no dns-01 challenge for %s", z.Identifier.Value)
+	}
+
+	value, err := client.DNS01ChallengeRecord(challenge.Token)
+	if err != nil {
+		return err
+	}
+	fqdn := "_acme-challenge." + strings.TrimPrefix(z.Identifier.Value, "*.")
+	if err := m.config.DNSHook.Present(ctx, fqdn, value); err != nil {
+		return err
+	}
+	defer func() {
+		if err := m.config.DNSHook.CleanUp(ctx, fqdn, value); err != nil {
+			m.logger.Warn("could not clean up dns challenge", "fqdn", fqdn, "err", err)
+		}
+	}()
+
+	if _, err := client.Accept(ctx, challenge); err != nil {
+		return errors.Wrap(err, "could not accept challenge")
+	}
+	if _, err := client.WaitAuthorization(ctx, z.URI); err != nil {
+		return errors.Wrapf(err, "could not authorize %s", z.Identifier.Value)
+	}
+	return nil
+}
+
+// accountKey loads or creates the account key of the wildcard certificate
+func (m *acmeManager) accountKey(ctx context.Context) (crypto.Signer, error) {
+	b, err := m.cache.Get(ctx, wildcardAccountKey)
+	if err == nil {
+		block, _ := pem.Decode(b)
+		if block == nil {
+			return nil, errors.New("invalid cached acme account key")
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if err != autocert.ErrCacheMiss {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := m.cache.Put(ctx, wildcardAccountKey, pemKey); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// loadCertificate reads the pem encoded key and certificates from the cache
+func (m *acmeManager) loadCertificate(ctx context.Context, name string) (*tls.Certificate, error) {
+	b, err := m.cache.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(b, b)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// storeCertificate writes the key and certificates to the cache as pem
+func (m *acmeManager) storeCertificate(ctx context.Context, name string, cert *tls.Certificate) error {
+	der, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	pem.Encode(&buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	for _, c := range cert.Certificate {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: c})
+	}
+	return m.cache.Put(ctx, name, buf.Bytes())
+}
@@ -0,0 +1,131 @@
+package hypro
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestServer_acmeHostPolicy(t *testing.T) {
+	s := &Server{
+		ACME:  &ACMEConfig{BaseDomain: "example.com"},
+		users: map[string]*user{"myapp.example.com": {}},
+	}
+	tests := []struct {
+		name    string
+		host    string
+		wantErr bool
+	}{
+		{"Base domain", "example.com", false},
+		{"Registered", "myapp.example.com", false},
+		{"Registered case insensitive", "MyApp.example.com", false},
+		{"Not registered", "other.example.com", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := s.acmeHostPolicy(context.Background(), tt.host); (err != nil) != tt.wantErr {
+				t.Errorf("acmeHostPolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_acmeRetryDelay(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{7, acmeRetryMax},
+		{100, acmeRetryMax},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.failures), func(t *testing.T) {
+			if got := acmeRetryDelay(tt.failures); got != tt.want {
+				t.Errorf("acmeRetryDelay(%d) = %v, want %v", tt.failures, got, tt.want)
+			}
+			if got := acmeRetryDelay(tt.failures); got >= acmeCheckInterval {
+				t.Errorf("acmeRetryDelay(%d) = %v, not shorter than the check interval", tt.failures, got)
+			}
+		})
+	}
+}
+
+// challtestsrvHook presents the dns-01 records with pebble-challtestsrv
+type challtestsrvHook string
+
+func (h challtestsrvHook) Present(ctx context.Context, fqdn, value string) error {
+	return h.post("/set-txt", fmt.Sprintf(`{"host":"%s.","value":"%s"}`, fqdn, value))
+}
+
+func (h challtestsrvHook) CleanUp(ctx context.Context, fqdn, value string) error {
+	return h.post("/clear-txt", fmt.Sprintf(`{"host":"%s."}`, fqdn))
+}
+
+func (h challtestsrvHook) post(path, body string) error {
+	resp, err := http.Post(string(h)+path, "application/json", bytes.NewBufferString(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// TestACMEWildcard obtains the wildcard certificate from a local Pebble, run with
+// PEBBLE_DIRECTORY=https://localhost:14000/dir PEBBLE_CA=pebble.minica.pem
+// CHALLTESTSRV=http://localhost:8055
+func TestACMEWildcard(t *testing.T) {
+	directory, caFile, challtestsrv := os.Getenv("PEBBLE_DIRECTORY"), os.Getenv("PEBBLE_CA"), os.Getenv("CHALLTESTSRV")
+	if directory == "" || caFile == "" || challtestsrv == "" {
+		t.Skip("PEBBLE_DIRECTORY, PEBBLE_CA and CHALLTESTSRV are required")
+	}
+
+	pool, err := loadCertPool(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := http.DefaultTransport.(*http.Transport)
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	defer func() { transport.TLSClientConfig = nil }()
+
+	s := &Server{ACME: &ACMEConfig{
+		DirectoryURL: directory,
+		CacheDir:     t.TempDir(),
+		BaseDomain:   "example.com",
+		DNSHook:      challtestsrvHook(challtestsrv),
+	}}
+	m, err := s.newACMEManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := m.renewWildcard(ctx); err != nil {
+		t.Fatalf("renewWildcard() error = %v", err)
+	}
+
+	cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "myapp.example.com"})
+	if err != nil {
+		t.Fatalf("GetCertificate() error = %v", err)
+	}
+	if err := cert.Leaf.VerifyHostname("myapp.example.com"); err != nil {
+		t.Errorf("VerifyHostname() error = %v", err)
+	}
+
+	// the cached certificate is reused
+	cached, err := m.loadCertificate(ctx, "wildcard+example.com")
+	if err != nil {
+		t.Fatalf("loadCertificate() error = %v", err)
+	}
+	if !cached.Leaf.Equal(cert.Leaf) {
+		t.Error("loadCertificate() is not the obtained certificate")
+	}
+}
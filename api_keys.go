@@ -0,0 +1,119 @@
+package hypro
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"os"
+
+	pb "github.com/chuangbo/hypro/protos"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// apiKeyMetadataKey is the grpc metadata the client sends its api key in
+const apiKeyMetadataKey = "hypro-api-key"
+
+// APIKey is a pre-shared key the client registers tunnels with
+type APIKey struct {
+	Key string `json:"key"`
+
+	// Domains are the domain patterns could be registered with the key,
+	// e.g. myapp.example.com or *.example.com. Any domain if empty
+	Domains []string `json:"domains"`
+
+	// MaxTunnels limits the domains registered with the key at the same
+	// time. Unlimited if 0
+	MaxTunnels int `json:"max_tunnels"`
+}
+
+// LoadAPIKeys reads the api keys from a json file of the list of APIKey
+func LoadAPIKeys(filename string) ([]*APIKey, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read api keys")
+	}
+	var keys []*APIKey
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return nil, errors.Wrapf(err, "could not parse api keys %s", filename)
+	}
+	for i, key := range keys {
+		if key.Key == "" {
+			return nil, errors.Errorf("empty api key at %d in %s", i, filename)
+		}
+	}
+	return keys, nil
+}
+
+// allows reports whether the domain could be registered with the key
+func (k *APIKey) allows(domain string) bool {
+	if len(k.Domains) == 0 {
+		return true
+	}
+	for _, pattern := range k.Domains {
+		if matchDomain(pattern, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+type apiKeyContextKey struct{}
+
+// apiKeyFromContext returns the api key authenticated by the interceptor
+func apiKeyFromContext(ctx context.Context) *APIKey {
+	key, _ := ctx.Value(apiKeyContextKey{}).(*APIKey)
+	return key
+}
+
+// authInterceptor authenticates the Register calls with the api keys
+func (s *Server) authInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if info.FullMethod != pb.Tunnel_Register_FullMethodName || len(s.APIKeys) == 0 {
+		return handler(ctx, req)
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	if len(md[apiKeyMetadataKey]) < 1 {
+		return nil, status.Errorf(codes.Unauthenticated, "api key required")
+	}
+	key := s.findAPIKey(md[apiKeyMetadataKey][0])
+	if key == nil {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid api key")
+	}
+	return handler(context.WithValue(ctx, apiKeyContextKey{}, key), req)
+}
+
+func (s *Server) findAPIKey(value string) *APIKey {
+	var found *APIKey
+	for _, key := range s.APIKeys {
+		if subtle.ConstantTimeCompare([]byte(key.Key), []byte(value)) == 1 {
+			found = key
+		}
+	}
+	return found
+}
+
+// checkAPIKey checks the domain is allowed and the key has not reached
+// its max tunnels. s.mu must be held
+func (s *Server) checkAPIKey(key *APIKey, domain string) error {
+	if !key.allows(domain) {
+		return status.Errorf(codes.PermissionDenied, "domain %s is not allowed by the api key", domain)
+	}
+	if key.MaxTunnels <= 0 {
+		return nil
+	}
+	n := 0
+	for _, c := range s.users {
+		// the stale registration of the same domain is replaced
+		if c.apiKey == key && c.host != domain {
+			n++
+		}
+	}
+	if n >= key.MaxTunnels {
+		return status.Errorf(codes.ResourceExhausted, "reached max tunnels %d of the api key", key.MaxTunnels)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package hypro
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/chuangbo/hypro/protos"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestLoadAPIKeys(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		filename := filepath.Join(dir, name)
+		if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+
+	tests := []struct {
+		name     string
+		filename string
+		wantKeys int
+		wantErr  bool
+	}{
+		{"OK", write("keys.json", `[{"key": "secret", "domains": ["*.example.com"], "max_tunnels": 3}, {"key": "other"}]`), 2, false},
+		{"Missing", filepath.Join(dir, "missing.json"), 0, true},
+		{"Invalid", write("invalid.json", `{"key": "secret"}`), 0, true},
+		{"Empty key", write("empty.json", `[{"key": "secret"}, {"domains": ["*.example.com"]}]`), 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := LoadAPIKeys(tt.filename)
+			if (err != nil) != tt.wantErr || len(keys) != tt.wantKeys {
+				t.Fatalf("LoadAPIKeys() = %v, %v, want %d keys, error %v", keys, err, tt.wantKeys, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("Fields", func(t *testing.T) {
+		keys, _ := LoadAPIKeys(filepath.Join(dir, "keys.json"))
+		if k := keys[0]; k.Key != "secret" || len(k.Domains) != 1 || k.Domains[0] != "*.example.com" || k.MaxTunnels != 3 {
+			t.Errorf("LoadAPIKeys() key = %+v", k)
+		}
+	})
+}
+
+func TestServer_authInterceptor(t *testing.T) {
+	key := &APIKey{Key: "secret"}
+	s := &Server{APIKeys: []*APIKey{{Key: "other"}, key}}
+	register := &grpc.UnaryServerInfo{FullMethod: pb.Tunnel_Register_FullMethodName}
+	withKey := func(value string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs(apiKeyMetadataKey, value))
+	}
+
+	tests := []struct {
+		name     string
+		server   *Server
+		ctx      context.Context
+		info     *grpc.UnaryServerInfo
+		wantCode codes.Code
+		wantKey  *APIKey
+	}{
+		{"OK", s, withKey("secret"), register, codes.OK, key},
+		{"Missing", s, context.Background(), register, codes.Unauthenticated, nil},
+		{"Wrong", s, withKey("wrong"), register, codes.Unauthenticated, nil},
+		{"Prefix", s, withKey("secre"), register, codes.Unauthenticated, nil},
+		{"Other method", s, context.Background(), &grpc.UnaryServerInfo{FullMethod: pb.Tunnel_Unregister_FullMethodName}, codes.OK, nil},
+		{"No keys", &Server{}, context.Background(), register, codes.OK, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotKey *APIKey
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				gotKey = apiKeyFromContext(ctx)
+				return req, nil
+			}
+			_, err := tt.server.authInterceptor(tt.ctx, &pb.RegisterRequest{}, tt.info, handler)
+			if got := status.Code(err); got != tt.wantCode {
+				t.Fatalf("authInterceptor() error = %v, want %v", err, tt.wantCode)
+			}
+			if gotKey != tt.wantKey {
+				t.Errorf("apiKeyFromContext() = %v, want %v", gotKey, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestServer_checkAPIKey(t *testing.T) {
+	limited := &APIKey{Key: "limited", Domains: []string{"*.example.com"}, MaxTunnels: 2}
+	unlimited := &APIKey{Key: "unlimited"}
+	s := &Server{users: map[string]*user{
+		"a.example.com": {host: "a.example.com", apiKey: limited},
+		"b.example.com": {host: "b.example.com", apiKey: limited},
+		"c.example.com": {host: "c.example.com", apiKey: unlimited},
+	}}
+
+	tests := []struct {
+		name     string
+		key      *APIKey
+		domain   string
+		wantCode codes.Code
+	}{
+		{"Out of scope", limited, "app.other.com", codes.PermissionDenied},
+		{"Wildcard base out of scope", limited, "example.com", codes.PermissionDenied},
+		{"Max tunnels", limited, "new.example.com", codes.ResourceExhausted},
+		{"Same domain replaced", limited, "a.example.com", codes.OK},
+		{"Unlimited", unlimited, "app.other.com", codes.OK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := s.checkAPIKey(tt.key, tt.domain); status.Code(err) != tt.wantCode {
+				t.Errorf("checkAPIKey() error = %v, want %v", err, tt.wantCode)
+			}
+		})
+	}
+}
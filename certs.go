@@ -0,0 +1,84 @@
+package hypro
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// certStore selects the certificate of the tls handshake by SNI
+type certStore struct {
+	certs []*tls.Certificate
+}
+
+// loadCertStore loads the pairs of certificate and key files
+func loadCertStore(certFiles, keyFiles []string) (*certStore, error) {
+	if len(certFiles) != len(keyFiles) {
+		return nil, errors.Errorf("%d certificates but %d keys", len(certFiles), len(keyFiles))
+	}
+	store := &certStore{}
+	for i := range certFiles {
+		cert, err := tls.LoadX509KeyPair(certFiles[i], keyFiles[i])
+		if err != nil {
+			return nil, errors.Wrapf(err, "certificates invalid %s", certFiles[i])
+		}
+		if err := store.add(&cert); err != nil {
+			return nil, errors.Wrapf(err, "certificates invalid %s", certFiles[i])
+		}
+	}
+	return store, nil
+}
+
+func (cs *certStore) add(cert *tls.Certificate) error {
+	if cert.Leaf == nil {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return err
+		}
+		cert.Leaf = leaf
+	}
+	cs.certs = append(cs.certs, cert)
+	return nil
+}
+
+// GetCertificate returns the certificate of the exact server name, or of
+// the matched wildcard name, or the first certificate as default
+func (cs *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert := cs.match(strings.ToLower(hello.ServerName))
+	if cert == nil && len(cs.certs) > 0 {
+		cert = cs.certs[0]
+	}
+	if cert == nil {
+		return nil, errors.Errorf("no certificate for %q", hello.ServerName)
+	}
+	return cert, nil
+}
+
+// match returns the certificate of the exact name, or of the matched wildcard name
+func (cs *certStore) match(name string) *tls.Certificate {
+	for _, cert := range cs.certs {
+		for _, n := range certNames(cert.Leaf) {
+			if strings.ToLower(n) == name {
+				return cert
+			}
+		}
+	}
+	for _, cert := range cs.certs {
+		for _, n := range certNames(cert.Leaf) {
+			if matchDomain(n, name) {
+				return cert
+			}
+		}
+	}
+	return nil
+}
+
+// certNames returns the DNS SANs, or the common name without SANs
+func certNames(leaf *x509.Certificate) []string {
+	if len(leaf.DNSNames) > 0 {
+		return leaf.DNSNames
+	}
+	return []string{leaf.Subject.CommonName}
+}
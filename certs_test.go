@@ -0,0 +1,71 @@
+package hypro
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// newTestCert returns a self-signed certificate of the names
+func newTestCert(t *testing.T, names ...string) *tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func Test_certStore_GetCertificate(t *testing.T) {
+	wildcard := newTestCert(t, "*.example.com")
+	exact := newTestCert(t, "myapp.example.com")
+	store := &certStore{}
+	store.add(wildcard)
+	store.add(exact)
+
+	tests := []struct {
+		name       string
+		serverName string
+		want       *tls.Certificate
+	}{
+		{"Exact", "myapp.example.com", exact},
+		{"Exact case insensitive", "MyApp.example.com", exact},
+		{"Wildcard", "other.example.com", wildcard},
+		{"Default", "example.org", wildcard},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: tt.serverName})
+			if err != nil || got != tt.want {
+				t.Errorf("GetCertificate() = %v, %v, want %v", got.Leaf.DNSNames, err, tt.want.Leaf.DNSNames)
+			}
+		})
+	}
+
+	if _, err := (&certStore{}).GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"}); err == nil {
+		t.Error("GetCertificate() of empty store error = nil, want error")
+	}
+}
@@ -2,14 +2,14 @@ package hypro // import "github.com/chuangbo/hypro"
 
 import (
 	"context"
+	"crypto/tls"
 	"crypto/x509"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	pb "github.com/chuangbo/hypro/protos"
@@ -17,12 +17,17 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
 )
 
-const (
-	// maxWaitingConnections is same as Chrome's max connections per site
-	maxWaitingConnections = 15
-)
+var errServerGoingAway = errors.New("server is going away")
+
+// connServer serves the connections accepted from the tunnel,
+// e.g. http.Server
+type connServer interface {
+	Serve(l net.Listener) error
+	Shutdown(ctx context.Context) error
+}
 
 // Client is a reverse proxy listen on hypro grpc tunnel
 type Client struct {
@@ -31,11 +36,44 @@ type Client struct {
 	ServerPort       int
 	Insecure         bool
 
-	token string
-	gc    *grpc.ClientConn
-	tc    pb.TunnelClient
+	// ClientCertFile and ClientKeyFile are the client certificate presented
+	// to the server requiring mutual TLS
+	ClientCertFile, ClientKeyFile string
+
+	// AuthKey is the api key to register with, if the server requires
+	AuthKey string
+
+	// RemotePort is the public port of a TCP or UDP tunnel, the server
+	// assigns one if it is zero
+	RemotePort int
+
+	// Tunnels are the domains served over the one connection to the server,
+	// only Domain is served if it is empty
+	Tunnels []*Tunnel
+
+	// Inspector records the requests of the HTTP tunnels, if set
+	Inspector *Inspector
+
+	// StateChanged is called on every connection state transition of the
+	// tunnels with the tunnel changed, err is the cause of StateReconnecting
+	// and StateClosed
+	StateChanged func(t *Tunnel, state ClientState, err error)
+
+	// Logger logs the events of the client, slog.Default() if nil
+	Logger *slog.Logger
+
+	gc *grpc.ClientConn
+	tc pb.TunnelClient
 
-	reqConns chan net.Conn
+	// tunnel is the tunnel of Domain when Tunnels is empty
+	tunnel *Tunnel
+
+	mu sync.Mutex // protects gc and shutdown, tc is set along with gc
+	// shutdown is closed when shutting down
+	shutdown chan struct{}
+
+	// lastConnID is the id of the last tunnel connection
+	lastConnID atomic.Uint64
 }
 
 // Dial connects hypro server at domain:port
@@ -44,11 +82,13 @@ func Dial(domain string, port int) (*Client, error) {
 	return c, c.Dial()
 }
 
-// Dial connects hypro server at domain:port
+// Dial connects hypro server at domain:port, and registers the tunnels
 func (c *Client) Dial() error {
-	// TODO: tls
+	for _, t := range c.tunnels() {
+		c.setState(t, StateConnecting, nil)
+	}
+
 	serverAddr := fmt.Sprintf("%s:%d", c.Server, c.ServerPort)
-	// log.Println("serverAddr", serverAddr)
 
 	var creds credentials.TransportCredentials
 
@@ -67,51 +107,86 @@ func (c *Client) Dial() error {
 		return errors.Wrapf(err, "failed to connect server %s", serverAddr)
 	}
 
-	c.gc = conn
-	c.tc = pb.NewTunnelClient(conn)
+	c.mu.Lock()
+	c.gc, c.tc = conn, pb.NewTunnelClient(conn)
+	c.mu.Unlock()
 
 	if err := c.CheckVersion(); err != nil {
 		return errors.Wrapf(err, "please upgrade hypro client")
 	}
-
 	if err := c.Register(); err != nil {
 		return err
 	}
 
-	if c.reqConns == nil {
-		c.reqConns = make(chan net.Conn)
+	for _, t := range c.tunnels() {
+		c.setState(t, StateConnected, nil)
 	}
-
 	return nil
 }
 
+// tunnels returns the Tunnels, or the tunnel of Domain if none
+func (c *Client) tunnels() []*Tunnel {
+	if len(c.Tunnels) > 0 {
+		return c.Tunnels
+	}
+	if c.tunnel == nil {
+		c.tunnel = &Tunnel{Domain: c.Domain, RemotePort: c.RemotePort}
+	}
+	return []*Tunnel{c.tunnel}
+}
+
+func (c *Client) logger() *slog.Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return slog.Default()
+}
+
+// register checks the version and registers the domain of the tunnel
+func (c *Client) register(t *Tunnel) error {
+	if err := c.CheckVersion(); err != nil {
+		return errors.Wrapf(err, "please upgrade hypro client")
+	}
+	return c.registerTunnel(t)
+}
+
 // Close closes the connection to the server
 func (c *Client) Close() error {
-	return c.gc.Close()
+	c.mu.Lock()
+	gc := c.gc
+	c.mu.Unlock()
+	if gc == nil {
+		return nil
+	}
+	return gc.Close()
 }
 
-// GetTransportCredentials returns tls credentials from cert file or system root ca
-func (c *Client) GetTransportCredentials() (creds credentials.TransportCredentials, err error) {
+// GetTransportCredentials returns tls credentials from cert file or system root ca,
+// with the client certificate if any
+func (c *Client) GetTransportCredentials() (credentials.TransportCredentials, error) {
+	config := &tls.Config{}
 	if c.CertFile != "" {
-		creds, err = credentials.NewClientTLSFromFile(c.CertFile, "")
+		rootCAs, err := loadCertPool(c.CertFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = rootCAs
 	} else {
 		rootCAs, err := x509.SystemCertPool()
 		if err != nil {
 			return nil, err
 		}
-		creds = credentials.NewClientTLSFromCert(rootCAs, "")
+		config.RootCAs = rootCAs
 	}
-	return
-}
 
-// Worker creates tunnels
-func (c *Client) Worker(errCh chan<- error) {
-	for {
-		if err := c.CreateTunnel(); err != nil {
-			errCh <- err
-			return
+	if c.ClientCertFile != "" || c.ClientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.ClientCertFile, c.ClientKeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "client certificate invalid")
 		}
+		config.Certificates = []tls.Certificate{cert}
 	}
+	return credentials.NewTLS(config), nil
 }
 
 // DialAndServe dials to the hypro server domain:port and then
@@ -123,32 +198,35 @@ func DialAndServe(domain string, port int, handler http.Handler) error {
 
 // DialAndServe connect to hypro grpc server to receive http request, and serve handler
 func (c *Client) DialAndServe(handler http.Handler) error {
-	if err := c.Dial(); err != nil {
-		return err
-	}
-	defer c.Close()
-
-	errCh := make(chan error)
+	c.tunnels()[0].handler = handler
+	return c.DialAndServeTunnels()
+}
 
-	// create tunnel loop
-	for i := 0; i < maxWaitingConnections; i++ {
-		go c.Worker(errCh)
-	}
+// DialAndServeTCP connect to hypro grpc server to receive tcp connections,
+// and pipe them to the target address
+func (c *Client) DialAndServeTCP(target string) error {
+	return c.dialAndServeTarget("tcp://", target)
+}
 
-	l, err := c.Listener()
-	if err != nil {
-		return errors.Wrap(err, "could not create listener")
-	}
-	// start the http server
-	go func() {
-		if err := http.Serve(l, handler); err != nil {
-			errCh <- errors.Wrap(err, "could not serve reverse proxy")
-		}
-	}()
+// DialAndServeUDP connect to hypro grpc server to receive udp datagrams,
+// and replay them to the target address
+func (c *Client) DialAndServeUDP(target string) error {
+	return c.dialAndServeTarget("udp://", target)
+}
 
-	log.Printf("The server is listen on: http://%s/", c.Domain)
+// DialAndServeTLSPassthrough connect to hypro grpc server to receive tls
+// connections routed by SNI, and pipe them still encrypted to the target
+// address, which terminates tls
+func (c *Client) DialAndServeTLSPassthrough(target string) error {
+	return c.dialAndServeTarget("tls://", target)
+}
 
-	return <-errCh
+func (c *Client) dialAndServeTarget(scheme, target string) error {
+	if target == "" {
+		return errors.New("target did not specific")
+	}
+	c.tunnels()[0].Target = scheme + target
+	return c.DialAndServeTunnels()
 }
 
 // DialAndServeReverseProxy dials to the hypro server domain:port and then
@@ -165,23 +243,172 @@ func DialAndServeReverseProxy(server string, port int, certFile string, domain,
 }
 
 // DialAndServeReverseProxy connect to hypro grpc server to receive http request,
-// and serve as reverse proxy to the target
+// and serve as reverse proxy to the target. The h2c:// or grpc:// targets are
+// proxied with h2c, e.g. gRPC services
 func (c *Client) DialAndServeReverseProxy(target string) error {
 	if target == "" {
 		return errors.New("target did not specific")
 	}
+	c.tunnels()[0].Target = target
+	return c.DialAndServeTunnels()
+}
 
-	targetURL, err := url.Parse(target)
-	if err != nil {
-		return errors.Wrapf(err, "target url invalid %s", target)
+// DialAndServeRoutes connect to hypro grpc server to receive http request,
+// and serve as reverse proxy to the target of the first route matching the path
+func (c *Client) DialAndServeRoutes(routes []Route) error {
+	if len(routes) == 0 {
+		return errors.New("routes did not specific")
 	}
+	c.tunnels()[0].Routes = routes
+	return c.DialAndServeTunnels()
+}
 
-	return c.DialAndServe(httputil.NewSingleHostReverseProxy(targetURL))
+// DialAndServeTunnels connect to hypro grpc server to register all the
+// tunnels, and serve each of them to its target, until all of them closed
+func (c *Client) DialAndServeTunnels() error {
+	tunnels := c.tunnels()
+	for _, t := range tunnels {
+		if t.logger == nil {
+			t.logger = c.logger()
+		}
+		if err := t.init(c.Inspector); err != nil {
+			return errors.Wrapf(err, "could not serve %s", t.Domain)
+		}
+	}
+
+	if err := c.Dial(); err != nil {
+		return err
+	}
+	defer func() {
+		// Shutdown closes the connection after unregistering
+		if !c.shuttingDown() {
+			c.Close()
+		}
+	}()
+
+	errCh := make(chan error, len(tunnels))
+	for _, t := range tunnels {
+		go func(t *Tunnel) {
+			errCh <- c.serveTunnel(t)
+		}(t)
+	}
+
+	// the other tunnels keep going if one of them is closed
+	var err error
+	for range tunnels {
+		if err1 := <-errCh; err == nil {
+			err = err1
+		}
+	}
+	return err
 }
 
-// Shutdown the server gracefully
-func (c *Client) Shutdown() error {
-	return errors.New("shutdown not implemented")
+// serveTunnel keeps the tunnel and serves its connections until it is closed
+func (c *Client) serveTunnel(t *Tunnel) error {
+	errCh := make(chan error, 2)
+
+	// all the connections are multiplexed over one tunnel
+	go func() {
+		errCh <- c.keepTunnel(t)
+	}()
+
+	l := t.listener()
+	go func() {
+		if err := t.srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			errCh <- errors.Wrap(err, "could not serve tunnel connections")
+		}
+	}()
+
+	t.log().Info("tunnel is ready", "url", t.url(), "target", t.Target)
+
+	err := <-errCh
+	l.Close()
+	c.setState(t, StateClosed, err)
+	return err
+}
+
+// Shutdown gracefully shuts down the client: it stops accepting new connections
+// from the server, waits for the in-flight requests until ctx is done, closes
+// the tunnels, unregisters the domains and then closes the connection to the server
+func (c *Client) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	if c.gc == nil {
+		c.mu.Unlock()
+		return errors.New("could not shutdown non-connected client")
+	}
+	done := c.doneLocked()
+	select {
+	case <-done:
+		c.mu.Unlock()
+		return nil
+	default:
+		close(done)
+	}
+	c.mu.Unlock()
+
+	c.logger().Info("shutting down")
+	tunnels := c.tunnels()
+	for _, t := range tunnels {
+		t.goAway()
+	}
+
+	var err error
+	for _, t := range tunnels {
+		// the tunnel is only dialed, its connections are not served
+		if t.srv == nil {
+			continue
+		}
+		// closes the listener and waits for the in-flight connections
+		if serr := t.srv.Shutdown(ctx); err == nil {
+			err = serr
+		}
+	}
+
+	for _, t := range tunnels {
+		t.closeTunnel()
+		if uerr := c.unregisterTunnel(t); uerr != nil {
+			t.log().Warn("could not unregister", "err", uerr)
+		}
+	}
+
+	if cerr := c.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// shuttingDown reports whether Shutdown was called
+func (c *Client) shuttingDown() bool {
+	select {
+	case <-c.done():
+		return true
+	default:
+		return false
+	}
+}
+
+// done returns the channel closed when shutting down
+func (c *Client) done() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.doneLocked()
+}
+
+// doneLocked is done with c.mu held
+func (c *Client) doneLocked() chan struct{} {
+	if c.shutdown == nil {
+		c.shutdown = make(chan struct{})
+	}
+	return c.shutdown
+}
+
+// Status returns the status of every tunnel
+func (c *Client) Status() []TunnelStatus {
+	var status []TunnelStatus
+	for _, t := range c.tunnels() {
+		status = append(status, t.status())
+	}
+	return status
 }
 
 // CheckVersion get the versions from server and check
@@ -201,109 +428,138 @@ func (c *Client) CheckVersion() error {
 	return nil
 }
 
-// Register the sub domain at the server.
+// Register the sub domains at the server.
 func (c *Client) Register() error {
-	log.Println("Registering", c.Domain)
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-	r, err := c.tc.Register(ctx, &pb.RegisterRequest{Domain: c.Domain})
-	if err != nil {
-		return errors.Wrapf(err, "could not register %s", c.Domain)
+	for _, t := range c.tunnels() {
+		if t.reqConns == nil {
+			t.reqConns = make(chan net.Conn)
+		}
+		if err := c.registerTunnel(t); err != nil {
+			return err
+		}
 	}
-	log.Println(r)
-	c.token = r.Token
 	return nil
 }
 
-// CreateTunnel connects to the server and forward to reverse proxy as new net.Conn
-func (c *Client) CreateTunnel() error {
-	log.Println("create tunnel")
-	errCh := make(chan error)
-
-	creds := &grpcAuth{host: c.Domain, token: c.token, insecure: c.Insecure}
-	stream, err := c.tc.CreateTunnel(context.Background(), grpc.PerRPCCredentials(creds))
+// registerTunnel registers the domain of the tunnel
+func (c *Client) registerTunnel(t *Tunnel) error {
+	t.mu.Lock()
+	domain, token, port := t.Domain, t.token, t.RemotePort
+	t.mu.Unlock()
 
+	t.log().Debug("registering")
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if c.AuthKey != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, apiKeyMetadataKey, c.AuthKey)
+	}
+	r, err := c.tc.Register(ctx, &pb.RegisterRequest{
+		Domain:   domain,
+		Token:    token,
+		Protocol: t.protocol,
+		Port:     uint32(port),
+		H2C:      t.h2c,
+	})
 	if err != nil {
-		return errors.Wrap(err, "could not create tunnel")
+		return errors.Wrapf(err, "could not register %s", domain)
+	}
+	t.log().Info("registered", "full_domain", r.FullDomain, "port", r.Port)
+	if (t.protocol == ProtocolTCP || t.protocol == ProtocolUDP) && r.Port == 0 {
+		return errors.Errorf("server does not support %s tunnels", t.protocol)
 	}
 
-	p1, p2 := net.Pipe()
-
-	go c.recvLoop(stream, p1, p2, errCh)
-	go c.sendLoop(stream, p1, errCh)
+	t.mu.Lock()
+	t.token, t.fullDomain = r.Token, r.FullDomain
+	if r.Domain != "" {
+		// the server assigns a domain if it is empty
+		t.Domain = r.Domain
+	}
+	if r.Port != 0 {
+		// keep the port on reconnect
+		t.RemotePort = int(r.Port)
+	}
+	t.mu.Unlock()
 
-	return <-errCh
+	if t == c.tunnel {
+		c.Domain, c.RemotePort = t.Domain, t.RemotePort
+	}
+	return nil
 }
 
-func (c *Client) recvLoop(stream pb.Tunnel_CreateTunnelClient, p1 io.WriteCloser, p2 net.Conn, errCh chan error) {
-	defer log.Println("tunnel closed")
-	defer close(errCh)
-
-	log.Println("start recv loop")
-	defer log.Println("recv loop stopped")
-	defer p1.Close()
+// Unregister releases the domains at the server.
+func (c *Client) Unregister() error {
+	for _, t := range c.tunnels() {
+		if err := c.unregisterTunnel(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	accepted := false
+// unregisterTunnel releases the domain of the tunnel
+func (c *Client) unregisterTunnel(t *Tunnel) error {
+	t.mu.Lock()
+	domain, token := t.Domain, t.token
+	t.mu.Unlock()
 
-	for {
-		packet, err := stream.Recv()
-		// log.Println("Received", packet, err)
-		if err == io.EOF {
-			log.Println("recv eof")
-			return
-		}
-		if err != nil {
-			log.Println("could not recv from stream:", err)
-			errCh <- err
-			return
-		}
-		if !accepted {
-			accepted = true
-			c.reqConns <- p2
-		}
-		log.Println("Received", len(packet.Data))
-		if len(packet.Data) > 0 {
-			// log.Println("writing", packet.Data)
-			nw, err := p1.Write(packet.Data)
-			if err != nil {
-				log.Println("could not write to pipe:", err)
-				return
-			}
-			if nw != len(packet.Data) {
-				// TODO: close with error
-				log.Println("could not write all to pipe:", io.ErrShortWrite)
-				return
-			}
-		}
+	t.log().Debug("unregistering")
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := c.tc.Unregister(ctx, &pb.UnregisterRequest{Domain: domain, Token: token})
+	if err != nil {
+		return errors.Wrapf(err, "could not unregister %s", domain)
 	}
+	return nil
 }
 
-func (c *Client) sendLoop(stream pb.Tunnel_CreateTunnelClient, p1 io.Reader, errCh chan error) {
-	log.Println("start send loop")
-	defer log.Println("send loop stopped")
+// CreateTunnel connects to the server and accepts the connections of Domain
+// multiplexed over it as new net.Conn, until the tunnel closed
+func (c *Client) CreateTunnel() error {
+	return c.createTunnel(c.tunnels()[0])
+}
 
-	buf := make([]byte, 32*1024)
+// createTunnel connects to the server and accepts the connections of the
+// tunnel multiplexed over it as new net.Conn, until the tunnel closed
+func (c *Client) createTunnel(t *Tunnel) error {
+	t.mu.Lock()
+	domain, token := t.Domain, t.token
+	t.mu.Unlock()
+	logger := t.log().With("conn_id", c.lastConnID.Add(1))
+	logger.Debug("creating tunnel")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx = metadata.AppendToOutgoingContext(ctx, muxMetadataKey, "1")
+	creds := &grpcAuth{host: domain, token: token, insecure: c.Insecure}
+	stream, err := c.tc.CreateTunnel(ctx, grpc.PerRPCCredentials(creds))
+	if err != nil {
+		cancel()
+		return errors.Wrap(err, "could not create tunnel")
+	}
 
-	for {
-		nr, err := p1.Read(buf)
-		if nr > 0 {
-			packet := &pb.Packet{Data: buf[0:nr]}
-			err := stream.Send(packet)
-			if err == io.EOF {
-				return
-			}
-			if err != nil {
-				log.Println("send error:", err)
-				errCh <- err
-				return
-			}
-		}
-		if err == io.EOF {
-			return
-		}
-		if err != nil {
-			log.Println("could not read from pipe:", err)
-			return
+	session := newMuxSession(stream, t.reqConns)
+	session.logger = logger
+	if t.udp != nil {
+		session.onDatagram = func(addr string, data []byte) {
+			t.udp.forward(session, addr, data)
 		}
 	}
+	t.mu.Lock()
+	t.session, t.cancelTunnel = session, cancel
+	t.mu.Unlock()
+
+	errCh := make(chan error, 1)
+	go func() {
+		defer logger.Debug("tunnel connection closed")
+		defer cancel()
+		errCh <- session.serve()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-session.goAway:
+		// the in-flight connections keep going on the session until the
+		// server closes it, while the new connections go to the new tunnel
+		return errServerGoingAway
+	}
 }
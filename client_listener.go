@@ -1,8 +1,9 @@
 package hypro
 
 import (
-	"log"
+	"log/slog"
 	"net"
+	"sync"
 
 	"github.com/pkg/errors"
 )
@@ -10,24 +11,23 @@ import (
 type listener struct {
 	reqConns <-chan net.Conn
 	done     chan struct{}
+	once     sync.Once
+	logger   *slog.Logger
 }
 
 // Listener returns net.Listener which accepts connection from hypro server
 func (c *Client) Listener() (net.Listener, error) {
-	if c.reqConns == nil {
+	t := c.tunnels()[0]
+	if t.reqConns == nil {
 		return nil, errors.New("could not create listener from non-connected client")
 	}
-	return &listener{
-		reqConns: c.reqConns,
-		done:     make(chan struct{}),
-	}, nil
+	return t.listener(), nil
 }
 
 func (l *listener) Accept() (net.Conn, error) {
-	log.Println("hypro.listener.Accept: waiting connection")
 	select {
 	case c := <-l.reqConns:
-		log.Println("hypro.listener.Accept: accepted new connection")
+		l.logger.Debug("connection accepted")
 		return c, nil
 	case <-l.done:
 		return nil, errors.New("hypro.listener.Accept: tunnel closed")
@@ -36,8 +36,10 @@ func (l *listener) Accept() (net.Conn, error) {
 
 // Close the listener
 func (l *listener) Close() error {
-	log.Println("close listener")
-	close(l.done)
+	l.once.Do(func() {
+		l.logger.Debug("listener closed")
+		close(l.done)
+	})
 	return nil
 }
 
@@ -0,0 +1,119 @@
+package hypro
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	reconnectMinBackoff = time.Second
+	reconnectMaxBackoff = 30 * time.Second
+)
+
+// ClientState is the connection state of the Client
+type ClientState int
+
+const (
+	// StateConnecting is dialing and registering to the server
+	StateConnecting ClientState = iota
+	// StateConnected is registered and accepting connections from the server
+	StateConnected
+	// StateReconnecting lost the tunnel and is waiting to connect again
+	StateReconnecting
+	// StateClosed gave up or stopped
+	StateClosed
+)
+
+func (s ClientState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+func (c *Client) setState(t *Tunnel, state ClientState, err error) {
+	t.mu.Lock()
+	t.state, t.err = state, err
+	t.mu.Unlock()
+	if err != nil {
+		t.log().Warn("tunnel "+state.String(), "err", err)
+	} else {
+		t.log().Info("tunnel " + state.String())
+	}
+	if c.StateChanged != nil {
+		c.StateChanged(t, state, err)
+	}
+}
+
+// keepTunnel serves the tunnel, and registers again and recreates the tunnel
+// with backoff after it is lost, until the server refuses the client
+func (c *Client) keepTunnel(t *Tunnel) error {
+	attempt := 0
+	for {
+		start := time.Now()
+		err := c.createTunnel(t)
+		if c.shuttingDown() {
+			return nil
+		}
+		if time.Since(start) > reconnectMaxBackoff {
+			attempt = 0
+		}
+		c.setState(t, StateReconnecting, err)
+
+		for {
+			select {
+			case <-time.After(backoff(attempt)):
+			case <-c.done():
+				return nil
+			}
+			attempt++
+			err := c.register(t)
+			if err == nil {
+				break
+			}
+			if !isRetryable(err) {
+				return err
+			}
+			t.log().Warn("could not reconnect", "attempt", attempt, "err", err)
+		}
+		c.setState(t, StateConnected, nil)
+	}
+}
+
+// backoff returns the exponential delay before the attempt with jitter
+func backoff(attempt int) time.Duration {
+	d := reconnectMaxBackoff
+	if attempt < 16 {
+		d = reconnectMinBackoff << uint(attempt)
+		if d > reconnectMaxBackoff {
+			d = reconnectMaxBackoff
+		}
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+// isRetryable reports whether the error is a temporary failure of the server
+// or the network, other than the server rejecting the client
+func isRetryable(err error) bool {
+	s, ok := status.FromError(errors.Cause(err))
+	if !ok {
+		return false
+	}
+	switch s.Code() {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted,
+		codes.Aborted, codes.Internal, codes.Unknown, codes.Canceled:
+		return true
+	}
+	return false
+}
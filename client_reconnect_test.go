@@ -0,0 +1,206 @@
+package hypro
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func Test_backoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		attempt  int
+		min, max time.Duration
+	}{
+		{"First attempt", 0, reconnectMinBackoff / 2, reconnectMinBackoff},
+		{"Third attempt", 2, 2 * reconnectMinBackoff, 4 * reconnectMinBackoff},
+		{"Capped", 10, reconnectMaxBackoff / 2, reconnectMaxBackoff},
+		{"Overflow", 100, reconnectMaxBackoff / 2, reconnectMaxBackoff},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				if got := backoff(tt.attempt); got < tt.min || got > tt.max {
+					t.Fatalf("backoff() = %v, want in [%v, %v]", got, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
+
+func Test_isRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"Unavailable", status.Error(codes.Unavailable, "connection refused"), true},
+		{"Wrapped unavailable", errors.Wrap(status.Error(codes.Unavailable, ""), "could not register"), true},
+		{"Already exists", status.Error(codes.AlreadyExists, "domain unavailable"), false},
+		{"Version incompatible", errors.New("version incompatible"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryable(tt.err); got != tt.want {
+				t.Errorf("isRetryable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClient_setState(t *testing.T) {
+	var gotTunnel *Tunnel
+	var gotState ClientState
+	var gotErr error
+	c := &Client{StateChanged: func(t *Tunnel, state ClientState, err error) {
+		gotTunnel, gotState, gotErr = t, state, err
+	}}
+	web, api := &Tunnel{Domain: "web.localhost"}, &Tunnel{Domain: "api.localhost"}
+	c.setState(web, StateConnected, nil)
+	lost := errors.New("stream lost")
+	c.setState(api, StateReconnecting, lost)
+	if gotTunnel != api || gotState != StateReconnecting || gotErr != lost {
+		t.Errorf("StateChanged(%v, %v, %v), want api.localhost reconnecting", gotTunnel.Domain, gotState, gotErr)
+	}
+	if web.status().State != StateConnected {
+		t.Errorf("web.localhost state = %v, want connected", web.status().State)
+	}
+}
+
+// killableProxy forwards the connections to addr until they are killed
+type killableProxy struct {
+	l     net.Listener
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func newKillableProxy(t *testing.T, addr string) *killableProxy {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &killableProxy{l: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("tcp", addr)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			p.mu.Lock()
+			p.conns = append(p.conns, conn, upstream)
+			p.mu.Unlock()
+			go pipe(conn, upstream)
+		}
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		p.kill()
+	})
+	return p
+}
+
+// kill closes all the forwarded connections
+func (p *killableProxy) kill() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+	p.conns = nil
+}
+
+func TestClient_reconnect(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer target.Close()
+
+	s := &Server{
+		GRPCAddr: fmt.Sprintf("127.0.0.1:%d", freePort(t)),
+		HTTPAddr: fmt.Sprintf("127.0.0.1:%d", freePort(t)),
+	}
+	go s.ListenAndServe()
+	defer s.Shutdown(context.Background())
+	waitForListener(t, s.GRPCAddr)
+	waitForListener(t, s.HTTPAddr)
+
+	const domain = "app.localhost"
+	proxy := newKillableProxy(t, s.GRPCAddr)
+	states := make(chan ClientState, 16)
+	c := &Client{
+		Server:       "127.0.0.1",
+		ServerPort:   proxy.l.Addr().(*net.TCPAddr).Port,
+		Domain:       domain,
+		Insecure:     true,
+		StateChanged: func(t *Tunnel, state ClientState, err error) { states <- state },
+	}
+	go c.DialAndServeReverseProxy(target.URL)
+	defer c.Shutdown(context.Background())
+
+	waitForState := func(want ClientState) {
+		t.Helper()
+		for {
+			select {
+			case got := <-states:
+				if got == want {
+					return
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("state %v not reached", want)
+			}
+		}
+	}
+	get := func() {
+		t.Helper()
+		r, _ := http.NewRequest("GET", "http://"+s.HTTPAddr+"/", nil)
+		r.Host = domain
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatalf("GET error = %v", err)
+		}
+		defer resp.Body.Close()
+		if b, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || string(b) != "ok" {
+			t.Errorf("GET = %d %q, want 200 ok", resp.StatusCode, b)
+		}
+	}
+
+	tunnelToken := func() string {
+		tn := c.tunnels()[0]
+		tn.mu.Lock()
+		defer tn.mu.Unlock()
+		return tn.token
+	}
+
+	waitForState(StateConnected)
+	get()
+	token := tunnelToken()
+
+	// the stream is lost without the server unregistering the domain
+	proxy.kill()
+	waitForState(StateReconnecting)
+	waitForState(StateConnected)
+
+	if got := tunnelToken(); got != token {
+		t.Errorf("token = %s after reconnecting, want %s", got, token)
+	}
+	if !s.Authenticated(domain, token) {
+		t.Errorf("%s is not reclaimed with the token", domain)
+	}
+	get()
+}
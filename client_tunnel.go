@@ -0,0 +1,226 @@
+package hypro
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Tunnel is a domain registered by the Client, with its own target
+type Tunnel struct {
+	// Domain to register, the server assigns one if it is empty
+	Domain string
+
+	// Target is forwarded to, e.g. http://localhost:8080, grpc://localhost:50051,
+	// tcp://localhost:5432, udp://localhost:53 or tls://localhost:8443
+	Target string
+
+	// RemotePort is the public port of a TCP or UDP tunnel, the server
+	// assigns one if it is zero
+	RemotePort int
+
+	// Routes forward the requests of an HTTP tunnel by their path to the
+	// first matched target in order, instead of the Target
+	Routes []Route
+
+	// Workers limits the requests of an HTTP tunnel, or the connections of
+	// a TCP or TLS tunnel, served at once, unlimited if zero
+	Workers int
+
+	// handler serves the http tunnel instead of the Target
+	handler  http.Handler
+	protocol Protocol
+	// h2c is whether the tunnel connections are served with h2c
+	h2c bool
+	srv connServer
+	// udp forwards the datagrams of a UDP tunnel
+	udp      *udpForwarder
+	reqConns chan net.Conn
+	// logger is the logger of the Client
+	logger *slog.Logger
+
+	mu           sync.Mutex // protects the fields below, Domain and RemotePort
+	token        string
+	fullDomain   string
+	session      *muxSession
+	cancelTunnel context.CancelFunc
+	state        ClientState
+	err          error
+}
+
+// TunnelStatus is the state of a Tunnel
+type TunnelStatus struct {
+	Domain, Target string
+	// URL is the public address of the tunnel
+	URL   string
+	State ClientState
+	// Err is the cause of StateReconnecting and StateClosed
+	Err error
+	// Connections is the number of the open connections over the tunnel
+	Connections int
+}
+
+// init prepares the server of the connections of the tunnel by its target,
+// the requests of an HTTP tunnel are recorded by the inspector if not nil
+func (t *Tunnel) init(inspector *Inspector) error {
+	if t.srv != nil {
+		return nil
+	}
+
+	handler := t.handler
+	if handler == nil && len(t.Routes) > 0 {
+		rt, err := newRouter(t.Routes)
+		if err != nil {
+			return err
+		}
+		handler = rt
+	}
+	if handler == nil {
+		if t.Target == "" {
+			return errors.New("target did not specific")
+		}
+		targetURL, err := url.Parse(t.Target)
+		if err != nil {
+			return errors.Wrapf(err, "target url invalid %s", t.Target)
+		}
+		switch targetURL.Scheme {
+		case "tcp":
+			t.protocol = ProtocolTCP
+			f := newTCPForwarder(targetURL.Host, t.Workers)
+			f.logger = t.log()
+			t.srv = f
+			return nil
+		case "tls":
+			t.protocol = ProtocolTLS
+			f := newTCPForwarder(targetURL.Host, t.Workers)
+			f.logger = t.log()
+			t.srv = f
+			return nil
+		case "udp":
+			t.protocol = ProtocolUDP
+			t.udp = newUDPForwarder(targetURL.Host)
+			t.udp.logger = t.log()
+			t.srv = t.udp
+			return nil
+		}
+		// the single target is the route of all the paths
+		rt, err := newRouter([]Route{{Target: t.Target}})
+		if err != nil {
+			return err
+		}
+		handler = rt
+	}
+
+	if inspector != nil {
+		handler = inspector.Handler(handler)
+	} else {
+		// the stamp of the server is only for the inspector
+		next := handler
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			receivedAt(r)
+			next.ServeHTTP(w, r)
+		})
+	}
+	if t.Workers > 0 {
+		handler = limitHandler(handler, t.Workers)
+	}
+	srv, err := newH2CServer(handler)
+	if err != nil {
+		return errors.Wrap(err, "could not configure h2c")
+	}
+	t.protocol, t.h2c, t.srv = ProtocolHTTP, true, srv
+	return nil
+}
+
+// limitHandler serves at most n requests of h at once, the others wait
+func limitHandler(h http.Handler, n int) http.Handler {
+	workers := make(chan struct{}, n)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case workers <- struct{}{}:
+		case <-r.Context().Done():
+			return
+		}
+		defer func() { <-workers }()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// log returns the logger with the domain of the tunnel
+func (t *Tunnel) log() *slog.Logger {
+	t.mu.Lock()
+	logger, domain := t.logger, t.Domain
+	t.mu.Unlock()
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return logger.With("host", domain)
+}
+
+// listener returns the listener of the connections of the tunnel
+func (t *Tunnel) listener() net.Listener {
+	return &listener{
+		reqConns: t.reqConns,
+		done:     make(chan struct{}),
+		logger:   t.log(),
+	}
+}
+
+// url returns the public address of the tunnel
+func (t *Tunnel) url() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch t.protocol {
+	case ProtocolTCP:
+		return "tcp://" + t.fullDomain
+	case ProtocolUDP:
+		return "udp://" + t.fullDomain
+	case ProtocolTLS:
+		return "https://" + t.fullDomain + "/"
+	}
+	return "http://" + t.fullDomain + "/"
+}
+
+func (t *Tunnel) status() TunnelStatus {
+	url := t.url()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := TunnelStatus{
+		Domain: t.Domain,
+		Target: t.Target,
+		URL:    url,
+		State:  t.state,
+		Err:    t.err,
+	}
+	if t.session != nil {
+		s.Connections = t.session.numConns()
+	}
+	return s
+}
+
+// goAway tells the server not to open connections on the tunnel any more
+func (t *Tunnel) goAway() {
+	t.mu.Lock()
+	session := t.session
+	t.mu.Unlock()
+	if session != nil {
+		if err := session.sendGoAway(); err != nil {
+			t.log().Warn("could not send goaway", "err", err)
+		}
+	}
+}
+
+// closeTunnel ends the tunnel stream
+func (t *Tunnel) closeTunnel() {
+	t.mu.Lock()
+	cancel := t.cancelTunnel
+	t.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
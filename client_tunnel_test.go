@@ -0,0 +1,213 @@
+package hypro
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClient_tunnels(t *testing.T) {
+	newTarget := func(name string) *httptest.Server {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, name)
+		}))
+		t.Cleanup(ts.Close)
+		return ts
+	}
+	web, api := newTarget("web"), newTarget("api")
+
+	s := &Server{
+		GRPCAddr: fmt.Sprintf("127.0.0.1:%d", freePort(t)),
+		HTTPAddr: fmt.Sprintf("127.0.0.1:%d", freePort(t)),
+	}
+	go s.ListenAndServe()
+	waitForListener(t, s.GRPCAddr)
+	waitForListener(t, s.HTTPAddr)
+
+	_, port, _ := net.SplitHostPort(s.GRPCAddr)
+	c := &Client{
+		Server:   "127.0.0.1",
+		Insecure: true,
+		Tunnels: []*Tunnel{
+			{Domain: "web.localhost", Target: web.URL},
+			{Domain: "api.localhost", Target: api.URL, Workers: 1},
+		},
+	}
+	fmt.Sscan(port, &c.ServerPort)
+	go c.DialAndServeTunnels()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		c.Shutdown(ctx)
+		s.Shutdown(ctx)
+	}()
+
+	for start := time.Now(); !s.TunnelExists("web.localhost") || !s.TunnelExists("api.localhost"); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("tunnels not created")
+		}
+	}
+
+	tests := []struct {
+		domain string
+		want   string
+	}{
+		{"web.localhost", "web"},
+		{"api.localhost", "api"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "http://"+s.HTTPAddr+"/", nil)
+			req.Host = tt.domain
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Do() error = %v", err)
+			}
+			defer resp.Body.Close()
+			if b, _ := io.ReadAll(resp.Body); string(b) != tt.want {
+				t.Errorf("body = %q, want %q", b, tt.want)
+			}
+		})
+	}
+
+	t.Run("Status", func(t *testing.T) {
+		_, httpPort, _ := net.SplitHostPort(s.HTTPAddr)
+		status := c.Status()
+		if len(status) != len(tests) {
+			t.Fatalf("Status() = %v, want %d tunnels", status, len(tests))
+		}
+		for i, st := range status {
+			if st.Domain != tests[i].domain || st.State != StateConnected {
+				t.Errorf("Status()[%d] = %+v, want %s connected", i, st, tests[i].domain)
+			}
+			if want := "http://" + tests[i].domain + ":" + httpPort + "/"; st.URL != want {
+				t.Errorf("Status()[%d].URL = %s, want %s", i, st.URL, want)
+			}
+		}
+	})
+}
+
+func Test_limitHandler(t *testing.T) {
+	release := make(chan struct{})
+	running, maxRunning := make(chan int, 1), 0
+	running <- 0
+	h := limitHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := <-running + 1
+		if n > maxRunning {
+			maxRunning = n
+		}
+		running <- n
+		<-release
+		running <- <-running - 1
+	}), 2)
+
+	done := make(chan struct{})
+	for i := 0; i < 5; i++ {
+		go func() {
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+			done <- struct{}{}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	for i := 0; i < 5; i++ {
+		<-done
+	}
+	if maxRunning != 2 {
+		t.Errorf("max running requests = %d, want 2", maxRunning)
+	}
+}
+
+func TestClient_Shutdown(t *testing.T) {
+	t.Run("Not connected", func(t *testing.T) {
+		if err := (&Client{}).Shutdown(context.Background()); err == nil {
+			t.Error("Shutdown() error = nil, want not connected")
+		}
+	})
+
+	target := httptest.NewServer(http.NotFoundHandler())
+	defer target.Close()
+	s := &Server{
+		GRPCAddr: fmt.Sprintf("127.0.0.1:%d", freePort(t)),
+		HTTPAddr: fmt.Sprintf("127.0.0.1:%d", freePort(t)),
+	}
+	go s.ListenAndServe()
+	defer s.Shutdown(context.Background())
+	waitForListener(t, s.GRPCAddr)
+
+	_, port, _ := net.SplitHostPort(s.GRPCAddr)
+	c := &Client{Server: "127.0.0.1", Domain: "app.localhost", Insecure: true}
+	fmt.Sscan(port, &c.ServerPort)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.DialAndServeReverseProxy(target.URL)
+	}()
+	for start := time.Now(); !s.TunnelExists("app.localhost"); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("tunnel not created")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown() error = %v", err)
+	}
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Errorf("DialAndServeReverseProxy() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("DialAndServeReverseProxy() did not return after Shutdown")
+	}
+	if s.TunnelExists("app.localhost") {
+		t.Error("app.localhost is not unregistered")
+	}
+	if err := c.Shutdown(ctx); err != nil {
+		t.Errorf("second Shutdown() error = %v", err)
+	}
+
+	t.Run("Dialed only", func(t *testing.T) {
+		c := &Client{Server: "127.0.0.1", Domain: "dialed.localhost", Insecure: true}
+		fmt.Sscan(port, &c.ServerPort)
+		if err := c.Dial(); err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		if err := c.Shutdown(ctx); err != nil {
+			t.Errorf("Shutdown() error = %v", err)
+		}
+		s.mu.RLock()
+		_, registered := s.users["dialed.localhost"]
+		s.mu.RUnlock()
+		if registered {
+			t.Error("dialed.localhost is not unregistered")
+		}
+	})
+
+	t.Run("While dialing", func(t *testing.T) {
+		c := &Client{Server: "127.0.0.1", Domain: "dialing.localhost", Insecure: true}
+		fmt.Sscan(port, &c.ServerPort)
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- c.DialAndServeReverseProxy(target.URL)
+		}()
+		for c.Shutdown(ctx) != nil {
+			select {
+			case err := <-errCh:
+				t.Fatalf("DialAndServeReverseProxy() = %v before Shutdown", err)
+			default:
+			}
+		}
+		select {
+		case <-errCh:
+		case <-time.After(5 * time.Second):
+			t.Fatal("DialAndServeReverseProxy() did not return after Shutdown")
+		}
+	})
+}
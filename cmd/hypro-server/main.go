@@ -1,22 +1,120 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/chuangbo/hypro"
 )
 
+// listFlag is the comma separated list flag
+type listFlag struct {
+	list *[]string
+}
+
+func (f listFlag) String() string {
+	if f.list == nil {
+		return ""
+	}
+	return strings.Join(*f.list, ",")
+}
+
+func (f listFlag) Set(s string) error {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	*f.list = list
+	return nil
+}
+
 func main() {
-	grpcAddr := flag.String("listen", ":49776", "API server listen address")
-	httpAddr := flag.String("http", ":80", "HTTP server listen address")
-	certFile := flag.String("cert", "", "Server certificate file")
-	keyFile := flag.String("key", "", "Server certificate key file")
+	// the flags override the config file
+	cfg := hypro.DefaultServerConfig()
+	if configFile := hypro.ConfigFlag(os.Args[1:]); configFile != "" {
+		if err := hypro.LoadServerConfig(configFile, cfg); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	flag.String("config", "", "Config file, e.g. `hypro-server.yaml` or hypro-server.toml, overridden by the flags")
+	flag.StringVar(&cfg.Listen, "listen", cfg.Listen, "API server listen address")
+	flag.StringVar(&cfg.HTTP, "http", cfg.HTTP, "HTTP server listen address")
+	flag.StringVar(&cfg.HTTPS, "https", cfg.HTTPS, "HTTPS server listen address, e.g. :443 (default: disabled)")
+	flag.Var(listFlag{&cfg.HTTPSCertFiles}, "https-cert", "Comma separated HTTPS certificate files, selected by SNI, e.g. wildcard.crt")
+	flag.Var(listFlag{&cfg.HTTPSKeyFiles}, "https-key", "Comma separated HTTPS certificate key files, in the order of -https-cert")
+	flag.StringVar(&cfg.Cert, "cert", cfg.Cert, "Server certificate file")
+	flag.StringVar(&cfg.Key, "key", cfg.Key, "Server certificate key file")
+	flag.StringVar(&cfg.ClientCA, "client-ca", cfg.ClientCA, "CA certificates to verify the client certificates, enables mutual TLS")
+	flag.DurationVar(&cfg.WaitTimeout, "wait-timeout", cfg.WaitTimeout, "Max time a request waits for the client's tunnel")
+	flag.DurationVar(&cfg.UpgradeIdleTimeout, "upgrade-idle-timeout", cfg.UpgradeIdleTimeout, "Max idle time of the upgraded connections, e.g. WebSocket")
+	flag.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", cfg.ShutdownTimeout, "Max time to wait for in-flight requests on shutdown")
+	flag.Var(listFlag{&cfg.DomainSuffixes}, "domain-suffix", "Comma separated base domains the clients could register under, e.g. example.com (default: any domain)")
+	flag.Var(listFlag{&cfg.Reserved}, "reserved", "Comma separated subdomain names the clients could not register")
+	flag.BoolVar(&cfg.ACME.Enabled, "acme", cfg.ACME.Enabled, "Obtain the HTTPS certificates from ACME, e.g. Let's Encrypt")
+	flag.StringVar(&cfg.ACME.Directory, "acme-directory", cfg.ACME.Directory, "ACME directory URL (default: Let's Encrypt)")
+	flag.StringVar(&cfg.ACME.Email, "acme-email", cfg.ACME.Email, "ACME account contact email")
+	flag.StringVar(&cfg.ACME.Cache, "acme-cache", cfg.ACME.Cache, "Directory to store the ACME account keys and certificates")
+	flag.StringVar(&cfg.ACME.Domain, "acme-domain", cfg.ACME.Domain, "Base domain of the wildcard certificate (default: the first -domain-suffix)")
+	flag.StringVar(&cfg.ACME.DNSHook, "acme-dns-hook", cfg.ACME.DNSHook, "Command to present/cleanup dns-01 TXT records, enables the wildcard certificate")
+	flag.StringVar(&cfg.TLS, "tls", cfg.TLS, "TLS passthrough listen address routed by SNI, e.g. :8443 (default: disabled)")
+	flag.StringVar(&cfg.TCPHost, "tcp-host", cfg.TCPHost, "Host the TCP and UDP tunnels listen on (default: all interfaces)")
+	flag.StringVar(&cfg.TCPPorts, "tcp-ports", cfg.TCPPorts, "Port range of the TCP and UDP tunnels, e.g. 20000-20999 (default: disabled)")
+	flag.StringVar(&cfg.AuthKeys, "auth-keys", cfg.AuthKeys, "JSON file of the API keys required to register, e.g. keys.json")
+	flag.StringVar(&cfg.AccessLog, "access-log", cfg.AccessLog, "Access log file of the HTTP requests, reopened on SIGHUP, or - for stdout (default: disabled)")
+	flag.StringVar(&cfg.AccessLogFormat, "access-log-format", cfg.AccessLogFormat, "Access log format: combined or json")
+	flag.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "Log level: debug, info, warn or error")
+	flag.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "Log format: text or json")
 	flag.Parse()
 
-	err := hypro.ListenAndServe(*grpcAddr, *httpAddr, *certFile, *keyFile)
+	server, err := cfg.NewServer()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "could not start the server at %s %s: %v\n", *grpcAddr, *httpAddr, err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.ListenAndServe()
+	}()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	// kill -HUP reopens the access log after it is rotated
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+
+	for {
+		select {
+		case err := <-errCh:
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "could not start the server at %s %s: %v\n", cfg.Listen, cfg.HTTP, err)
+			}
+			return
+		case <-hupCh:
+			if server.AccessLog == nil {
+				continue
+			}
+			if f, ok := server.AccessLog.Writer.(*hypro.LogFile); ok {
+				if err := f.Reopen(); err != nil {
+					fmt.Fprintf(os.Stderr, "could not reopen the access log: %v\n", err)
+				}
+			}
+		case <-sigCh:
+			ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+			defer cancel()
+			if err := server.Shutdown(ctx); err != nil {
+				fmt.Fprintf(os.Stderr, "could not shutdown gracefully: %v\n", err)
+			}
+			return
+		}
 	}
 }
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/chuangbo/hypro"
+)
+
+// configCommand runs hypro config validate, and returns the exit code
+func configCommand(args []string) int {
+	if len(args) == 0 || args[0] != "validate" {
+		fmt.Fprintf(os.Stderr, "Usage: %s config validate [-server] hypro.yaml\n", os.Args[0])
+		return 2
+	}
+	fs := flag.NewFlagSet("config validate", flag.ExitOnError)
+	server := fs.Bool("server", false, "Validate the config file of hypro-server")
+	fs.Parse(args[1:])
+	if fs.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s config validate [-server] hypro.yaml\n", os.Args[0])
+		return 2
+	}
+
+	code := 0
+	for _, file := range fs.Args() {
+		if err := validateConfig(file, *server); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			code = 1
+			continue
+		}
+		fmt.Printf("%s: ok\n", file)
+	}
+	return code
+}
+
+func validateConfig(file string, server bool) error {
+	if server {
+		cfg := hypro.DefaultServerConfig()
+		if err := hypro.LoadServerConfig(file, cfg); err != nil {
+			return err
+		}
+		return cfg.Validate()
+	}
+	cfg := hypro.DefaultClientConfig()
+	if err := hypro.LoadClientConfig(file, cfg); err != nil {
+		return err
+	}
+	return cfg.Validate()
+}
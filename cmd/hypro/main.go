@@ -1,33 +1,174 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/chuangbo/hypro"
 )
 
 func usage() {
 	fmt.Fprintf(os.Stderr, "Usage: %s -server hypro.cloud -domain myapp.hypro.cloud -target http://localhost:8080\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s -server hypro.cloud -tunnel web.hypro.cloud=http://localhost:8080 -tunnel api.hypro.cloud=http://localhost:9090,workers=10\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s -config hypro.yaml\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s config validate [-server] hypro.yaml\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s replay [-method POST] [-header 'key: value'] [-body-file body.json] id\n", os.Args[0])
 }
 
 func main() {
-	domain := flag.String("domain", "", "Domain you would like to use, e.g. `myapp.hypro.cloud`")
-	server := flag.String("server", "", "Server address, e.g. hypro.cloud")
-	serverPort := flag.Int("server-port", 49776, "Server port")
-	target := flag.String("target", "", "Forward target, e.g. http://localhost:8080")
-	certFile := flag.String("cert", "", "Server certificate file to verify connection, e.g. hypro.crt (default: system root ca)")
-	insecure := flag.Bool("insecure", false, "Allow connections to hypro server without certs")
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(configCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(replayCommand(os.Args[2:]))
+	}
+
+	// the flags override the config file
+	cfg := hypro.DefaultClientConfig()
+	if configFile := hypro.ConfigFlag(os.Args[1:]); configFile != "" {
+		if err := hypro.LoadClientConfig(configFile, cfg); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	flag.String("config", "", "Config file, e.g. `hypro.yaml` or hypro.toml, overridden by the flags")
+	flag.StringVar(&cfg.Server, "server", cfg.Server, "Server address, e.g. hypro.cloud")
+	flag.IntVar(&cfg.ServerPort, "server-port", cfg.ServerPort, "Server port")
+	flag.StringVar(&cfg.Cert, "cert", cfg.Cert, "Server certificate file to verify connection, e.g. hypro.crt (default: system root ca)")
+	flag.BoolVar(&cfg.Insecure, "insecure", cfg.Insecure, "Allow connections to hypro server without certs")
+	flag.StringVar(&cfg.ClientCert, "client-cert", cfg.ClientCert, "Client certificate file for servers requiring mutual TLS")
+	flag.StringVar(&cfg.ClientKey, "client-key", cfg.ClientKey, "Client certificate key file for servers requiring mutual TLS")
+	flag.StringVar(&cfg.AuthKey, "auth-key", cfg.AuthKey, "API key to register the domain with, if the server requires")
+	flag.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", cfg.ShutdownTimeout, "Max time to wait for in-flight requests on shutdown")
+	flag.StringVar(&cfg.Inspect, "inspect", cfg.Inspect, "Address of the inspector dashboard of the requests, disabled if empty")
+	flag.StringVar(&cfg.HAROut, "har-out", cfg.HAROut, "Write all the recorded requests to the HAR file as they are served, e.g. `traffic.har`")
+	flag.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "Log level: debug, info, warn or error")
+	flag.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "Log format: text or json")
+
+	domain := flag.String("domain", "", "Domain you would like to use, e.g. `myapp.hypro.cloud` (default: assigned by the server)")
+	target := flag.String("target", "", "Forward target, e.g. http://localhost:8080, grpc://localhost:50051 for a gRPC service, tcp://localhost:5432 for a TCP tunnel, udp://localhost:53 for a UDP tunnel, or tls://localhost:8443 for a TLS passthrough tunnel")
+	remotePort := flag.Int("remote-port", 0, "Public port of the TCP or UDP tunnel on the server (default: assigned by the server)")
+	workers := flag.Int("workers", 0, "Max requests, or connections of a TCP or TLS tunnel, served at once (default: unlimited)")
+	var routes routeFlags
+	flag.Var(&routes, "route", "Route `path=target[,strip][,host=H]` of the -domain in order, e.g. /api/=http://localhost:8080,strip, the path starting with ~ is a regexp, and -target is the last route. May be repeated")
+	serve := flag.String("serve", "", "Serve the files of the directory instead of -target, e.g. `./dist`")
+	listing := flag.Bool("listing", false, "List the files of the directories without index.html with -serve")
+	spa := flag.Bool("spa", false, "Serve /index.html for the paths not found with -serve, for single page apps")
+	dotfiles := flag.Bool("dotfiles", false, "Serve the files starting with . with -serve, e.g. .well-known, instead of hiding them")
+	basicAuth := flag.String("basic-auth", "", "Require the `user:password` with basic auth with -serve")
+	var tunnels tunnelFlags
+	flag.Var(&tunnels, "tunnel", "Additional tunnel `domain=target[,port=N][,workers=N]`, may be repeated")
 	flag.Parse()
 
-	if *target == "" || *domain == "" || *server == "" {
+	// the tunnel of the flags and the -tunnel flags go after the tunnels of
+	// the config file, or replace the ones with the same domain
+	var flagTunnels []*hypro.TunnelConfig
+	if *target != "" || len(routes) > 0 || *serve != "" {
+		t := &hypro.TunnelConfig{
+			Domain:  *domain,
+			Target:  *target,
+			Port:    *remotePort,
+			Workers: *workers,
+			Routes:  routes,
+		}
+		if *serve != "" {
+			t.Serve = &hypro.ServeConfig{Dir: *serve, Listing: *listing, SPA: *spa, Dotfiles: *dotfiles, BasicAuth: *basicAuth}
+		}
+		flagTunnels = append(flagTunnels, t)
+	}
+	flagTunnels = append(flagTunnels, tunnels...)
+	cfg.AddFlagTunnels(flagTunnels...)
+
+	if len(cfg.Tunnels) == 0 || cfg.Server == "" {
 		usage()
 		return
 	}
 
-	if err := hypro.DialAndServeReverseProxy(*server, *serverPort, *certFile, *domain, *target, *insecure); err != nil {
-		fmt.Fprintf(os.Stderr, "Could not connect to the server: %v\n", err)
+	client, err := cfg.NewClient()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if cfg.Inspect != "" {
+		serveInspector(cfg.Inspect, client.Inspector)
+	}
+	if cfg.HAROut != "" {
+		closeHAR, err := streamHAR(cfg.HAROut, client.Inspector)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not write the HAR file: %v\n", err)
+			os.Exit(2)
+		}
+		defer closeHAR()
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- client.DialAndServeTunnels()
+	}()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	// kill -USR1 prints the status of the tunnels
+	statusCh := make(chan os.Signal, 1)
+	notifyStatus(statusCh)
+
+	for {
+		select {
+		case err := <-errCh:
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Could not connect to the server: %v\n", err)
+			}
+			return
+		case <-statusCh:
+			printStatus(os.Stderr, client.Status())
+		case <-sigCh:
+			ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+			defer cancel()
+			if err := client.Shutdown(ctx); err != nil {
+				fmt.Fprintf(os.Stderr, "Could not shutdown gracefully: %v\n", err)
+			}
+			return
+		}
+	}
+}
+
+// serveInspector serves the inspector dashboard in background, the tunnels
+// keep going without it if the address is in use
+func serveInspector(addr string, inspector *hypro.Inspector) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not start the inspector: %v\n", err)
 		return
 	}
+	fmt.Fprintf(os.Stderr, "Inspect the requests on: http://%s/\n", l.Addr())
+	go http.Serve(l, inspector)
+}
+
+// streamHAR writes every recorded request to the HAR file as it is recorded,
+// the returned func completes the file on exit
+func streamHAR(file string, inspector *hypro.Inspector) (func(), error) {
+	f, err := os.Create(file)
+	if err != nil {
+		return nil, err
+	}
+	hw, err := hypro.NewHARWriter(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	inspector.OnRecord = func(e *hypro.Exchange) { hw.Write(e) }
+	return func() {
+		if err := hw.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not write the HAR file: %v\n", err)
+		}
+		f.Close()
+	}, nil
 }
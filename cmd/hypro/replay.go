@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chuangbo/hypro"
+	"github.com/pkg/errors"
+)
+
+// headerFlags is the repeated -header flag of hypro replay
+type headerFlags []string
+
+func (h *headerFlags) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerFlags) Set(value string) error {
+	if !strings.Contains(value, ":") {
+		return errors.Errorf("header %s should be key: value", value)
+	}
+	*h = append(*h, value)
+	return nil
+}
+
+// replayCommand runs hypro replay, and returns the exit code
+func replayCommand(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s replay [-method POST] [-header 'key: value'] [-body-file body.json] id\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	inspect := fs.String("inspect", hypro.DefaultClientConfig().Inspect, "Address of the inspector of the running client")
+	method := fs.String("method", "", "Replace the method of the request")
+	target := fs.String("url", "", "Replace the path and the query of the request, e.g. `/hook?retry=1`")
+	var headers headerFlags
+	fs.Var(&headers, "header", "Set the header `key: value` of the request, or remove it if the value is empty. May be repeated")
+	body := fs.String("body", "", "Replace the body of the request")
+	bodyFile := fs.String("body-file", "", "Replace the body of the request with the file, or stdin if -")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	id, err := strconv.ParseInt(fs.Arg(0), 10, 64)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid request id %s\n", fs.Arg(0))
+		return 2
+	}
+
+	edit := &hypro.Replay{Method: *method, URL: *target}
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "body" {
+			b := []byte(*body)
+			edit.Body = &b
+		}
+	})
+	if *bodyFile != "" {
+		b, err := readBodyFile(*bodyFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		edit.Body = &b
+	}
+
+	c := &inspectorClient{baseURL: "http://" + *inspect + "/api/requests/"}
+	if len(headers) > 0 {
+		// the headers are edited on top of the recorded ones
+		e, err := c.get(id)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		edit.Header = e.Request.Header
+		for _, h := range headers {
+			key, value, _ := strings.Cut(h, ":")
+			key, value = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(key)), strings.TrimSpace(value)
+			if value == "" {
+				edit.Header.Del(key)
+				continue
+			}
+			edit.Header.Set(key, value)
+		}
+	}
+
+	e, err := c.replay(id, edit)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "#%d %s %s%s %d %v\n", e.ID, e.Request.Method, e.Request.Host, e.Request.URL, e.Response.Status, e.Duration.Round(time.Millisecond))
+	os.Stdout.Write(e.Response.Body)
+	if e.Response.Truncated {
+		fmt.Fprintf(os.Stderr, "\n(%d of %d bytes)\n", len(e.Response.Body), e.Response.BodySize)
+	}
+	return 0
+}
+
+func readBodyFile(file string) ([]byte, error) {
+	if file == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(file)
+}
+
+// inspectorClient calls the api of the inspector of a running client
+type inspectorClient struct {
+	baseURL string
+}
+
+func (c *inspectorClient) get(id int64) (*hypro.Exchange, error) {
+	resp, err := http.Get(c.baseURL + strconv.FormatInt(id, 10))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not connect to the inspector")
+	}
+	return decodeExchange(resp)
+}
+
+func (c *inspectorClient) replay(id int64, edit *hypro.Replay) (*hypro.Exchange, error) {
+	b, err := json.Marshal(edit)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.Post(c.baseURL+strconv.FormatInt(id, 10)+"/replay", "application/json", bytes.NewReader(b))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not connect to the inspector")
+	}
+	return decodeExchange(resp)
+}
+
+func decodeExchange(resp *http.Response) (*hypro.Exchange, error) {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return nil, errors.Errorf("inspector: %s", bytes.TrimSpace(msg))
+	}
+	e := &hypro.Exchange{}
+	if err := json.NewDecoder(resp.Body).Decode(e); err != nil {
+		return nil, errors.Wrap(err, "invalid response of the inspector")
+	}
+	return e, nil
+}
@@ -0,0 +1,8 @@
+//go:build windows || plan9
+
+package main
+
+import "os"
+
+// notifyStatus does nothing, there is no SIGUSR1 on the platform
+func notifyStatus(c chan<- os.Signal) {}
@@ -0,0 +1,14 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyStatus relays kill -USR1 to c to print the status of the tunnels
+func notifyStatus(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/chuangbo/hypro"
+)
+
+// tunnelFlags is the repeated -tunnel flag, e.g.
+// -tunnel api.hypro.cloud=http://localhost:8080,workers=10
+type tunnelFlags []*hypro.TunnelConfig
+
+func (f *tunnelFlags) String() string {
+	var s []string
+	for _, t := range *f {
+		s = append(s, t.Domain+"="+t.Target)
+	}
+	return strings.Join(s, " ")
+}
+
+func (f *tunnelFlags) Set(value string) error {
+	t, err := parseTunnel(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, t)
+	return nil
+}
+
+// parseTunnel parses domain=target[,port=N][,workers=N]
+func parseTunnel(value string) (*hypro.TunnelConfig, error) {
+	options := strings.Split(value, ",")
+	domain, target, ok := strings.Cut(options[0], "=")
+	if !ok || target == "" {
+		return nil, fmt.Errorf("tunnel %q should be domain=target", value)
+	}
+	t := &hypro.TunnelConfig{Domain: domain, Target: target}
+	for _, option := range options[1:] {
+		key, v, _ := strings.Cut(option, "=")
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("tunnel %q option %q should be a number", value, key)
+		}
+		switch key {
+		case "port":
+			t.Port = n
+		case "workers":
+			t.Workers = n
+		default:
+			return nil, fmt.Errorf("tunnel %q option %q unknown, should be port or workers", value, key)
+		}
+	}
+	return t, nil
+}
+
+// routeFlags is the repeated -route flag, e.g.
+// -route /api/=http://localhost:8080,strip,host=localhost:8080
+type routeFlags []hypro.Route
+
+func (f *routeFlags) String() string {
+	var s []string
+	for _, r := range *f {
+		s = append(s, r.Path+r.Regexp+"="+r.Target)
+	}
+	return strings.Join(s, " ")
+}
+
+func (f *routeFlags) Set(value string) error {
+	r, err := parseRoute(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, r)
+	return nil
+}
+
+// parseRoute parses path=target[,strip][,host=H], the path starting with ~
+// is a regexp
+func parseRoute(value string) (hypro.Route, error) {
+	var r hypro.Route
+	path, rest, ok := strings.Cut(value, "=")
+	if !ok || path == "" {
+		return r, fmt.Errorf("route %q should be path=target", value)
+	}
+	if re, ok := strings.CutPrefix(path, "~"); ok {
+		r.Regexp = re
+	} else {
+		r.Path = path
+	}
+	options := strings.Split(rest, ",")
+	r.Target = options[0]
+	if r.Target == "" {
+		return r, fmt.Errorf("route %q should be path=target", value)
+	}
+	for _, option := range options[1:] {
+		key, v, _ := strings.Cut(option, "=")
+		switch key {
+		case "strip":
+			r.StripPrefix = true
+		case "host":
+			r.Host = v
+		default:
+			return r, fmt.Errorf("route %q option %q unknown, should be strip or host", value, key)
+		}
+	}
+	return r, nil
+}
+
+// printStatus prints the status of every tunnel as a table
+func printStatus(w io.Writer, status []hypro.TunnelStatus) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "DOMAIN\tTARGET\tURL\tSTATE\tCONNECTIONS\tERROR")
+	for _, s := range status {
+		errMsg := ""
+		if s.Err != nil {
+			errMsg = s.Err.Error()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\n", s.Domain, s.Target, s.URL, s.State, s.Connections, errMsg)
+	}
+	tw.Flush()
+}
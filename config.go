@@ -0,0 +1,855 @@
+package hypro
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// ClientConfig is the config file of the hypro client
+type ClientConfig struct {
+	Server     string `yaml:"server" toml:"server"`
+	ServerPort int    `yaml:"server_port" toml:"server_port"`
+	Cert       string `yaml:"cert" toml:"cert"`
+	Insecure   bool   `yaml:"insecure" toml:"insecure"`
+	ClientCert string `yaml:"client_cert" toml:"client_cert"`
+	ClientKey  string `yaml:"client_key" toml:"client_key"`
+	AuthKey    string `yaml:"auth_key" toml:"auth_key"`
+
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+
+	// Inspect is the address of the inspector dashboard, disabled if empty
+	Inspect string `yaml:"inspect" toml:"inspect"`
+	// HAROut is the HAR file the requests are written to as they are recorded,
+	// if set
+	HAROut string `yaml:"har_out" toml:"har_out"`
+
+	// LogLevel is debug, info, warn or error, and LogFormat is text or json
+	LogLevel  string `yaml:"log_level" toml:"log_level"`
+	LogFormat string `yaml:"log_format" toml:"log_format"`
+
+	Tunnels []*TunnelConfig `yaml:"tunnels" toml:"tunnels"`
+
+	source configSource
+}
+
+// TunnelConfig is a tunnel of the client config file, forwarded to the
+// Target, the Routes, or the files of Serve
+type TunnelConfig struct {
+	Domain  string       `yaml:"domain" toml:"domain"`
+	Target  string       `yaml:"target" toml:"target"`
+	Port    int          `yaml:"port" toml:"port"`
+	Workers int          `yaml:"workers" toml:"workers"`
+	Routes  []Route      `yaml:"routes" toml:"routes"`
+	Serve   *ServeConfig `yaml:"serve" toml:"serve"`
+
+	// fromFlags is set by AddFlagTunnels, its errors are not in the file
+	fromFlags bool
+}
+
+// ServeConfig is the directory of static files served by a tunnel
+type ServeConfig struct {
+	Dir     string `yaml:"dir" toml:"dir"`
+	Listing bool   `yaml:"listing" toml:"listing"`
+	SPA     bool   `yaml:"spa" toml:"spa"`
+	// Dotfiles serves the files starting with ".", e.g. .well-known
+	Dotfiles bool `yaml:"dotfiles" toml:"dotfiles"`
+	// BasicAuth is user:password required with basic auth
+	BasicAuth string `yaml:"basic_auth" toml:"basic_auth"`
+}
+
+// ServerConfig is the config file of the hypro server
+type ServerConfig struct {
+	Listen         string   `yaml:"listen" toml:"listen"`
+	HTTP           string   `yaml:"http" toml:"http"`
+	HTTPS          string   `yaml:"https" toml:"https"`
+	HTTPSCertFiles []string `yaml:"https_cert_files" toml:"https_cert_files"`
+	HTTPSKeyFiles  []string `yaml:"https_key_files" toml:"https_key_files"`
+	TLS            string   `yaml:"tls" toml:"tls"`
+	Cert           string   `yaml:"cert" toml:"cert"`
+	Key            string   `yaml:"key" toml:"key"`
+	ClientCA       string   `yaml:"client_ca" toml:"client_ca"`
+
+	WaitTimeout        time.Duration `yaml:"wait_timeout" toml:"wait_timeout"`
+	UpgradeIdleTimeout time.Duration `yaml:"upgrade_idle_timeout" toml:"upgrade_idle_timeout"`
+	ShutdownTimeout    time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+
+	DomainSuffixes []string `yaml:"domain_suffixes" toml:"domain_suffixes"`
+	Reserved       []string `yaml:"reserved" toml:"reserved"`
+
+	TCPHost  string `yaml:"tcp_host" toml:"tcp_host"`
+	TCPPorts string `yaml:"tcp_ports" toml:"tcp_ports"`
+
+	// AuthKeys is the json file of the api keys, see LoadAPIKeys
+	AuthKeys string `yaml:"auth_keys" toml:"auth_keys"`
+
+	ACME ServerACMEConfig `yaml:"acme" toml:"acme"`
+
+	// AccessLog is the file of the access log, - for stdout, disabled if empty
+	AccessLog string `yaml:"access_log" toml:"access_log"`
+	// AccessLogFormat is combined or json
+	AccessLogFormat string `yaml:"access_log_format" toml:"access_log_format"`
+
+	// LogLevel is debug, info, warn or error, and LogFormat is text or json
+	LogLevel  string `yaml:"log_level" toml:"log_level"`
+	LogFormat string `yaml:"log_format" toml:"log_format"`
+
+	source configSource
+}
+
+// ServerACMEConfig is the acme section of the server config file
+type ServerACMEConfig struct {
+	Enabled   bool   `yaml:"enabled" toml:"enabled"`
+	Directory string `yaml:"directory" toml:"directory"`
+	Email     string `yaml:"email" toml:"email"`
+	Cache     string `yaml:"cache" toml:"cache"`
+	// Domain is the base domain of the wildcard certificate
+	Domain  string `yaml:"domain" toml:"domain"`
+	DNSHook string `yaml:"dns_hook" toml:"dns_hook"`
+}
+
+// DefaultClientConfig returns the client config without the config file
+func DefaultClientConfig() *ClientConfig {
+	return &ClientConfig{
+		ServerPort:      49776,
+		ShutdownTimeout: 30 * time.Second,
+		Inspect:         "127.0.0.1:4040",
+		LogLevel:        "info",
+		LogFormat:       "text",
+	}
+}
+
+// DefaultServerConfig returns the server config without the config file
+func DefaultServerConfig() *ServerConfig {
+	return &ServerConfig{
+		Listen:             ":49776",
+		HTTP:               ":80",
+		WaitTimeout:        10 * time.Second,
+		UpgradeIdleTimeout: 10 * time.Minute,
+		ShutdownTimeout:    30 * time.Second,
+		Reserved:           []string{"www", "api", "admin"},
+		ACME:               ServerACMEConfig{Cache: "acme-cache"},
+		AccessLogFormat:    AccessLogCombined,
+		LogLevel:           "info",
+		LogFormat:          "text",
+	}
+}
+
+// ConfigError is an invalid value in the config file
+type ConfigError struct {
+	File string
+	// Line is 0 if unknown
+	Line int
+	// Field is the path of the value, e.g. tunnels[1].target
+	Field string
+	Err   error
+}
+
+func (e *ConfigError) Error() string {
+	var b strings.Builder
+	if e.File != "" {
+		b.WriteString(e.File)
+		if e.Line > 0 {
+			fmt.Fprintf(&b, ":%d", e.Line)
+		}
+		b.WriteString(": ")
+	}
+	if e.Field != "" {
+		b.WriteString(e.Field + ": ")
+	}
+	b.WriteString(e.Err.Error())
+	return b.String()
+}
+
+// ConfigErrors are all the errors of the config file
+type ConfigErrors []*ConfigError
+
+func (errs ConfigErrors) Error() string {
+	s := make([]string, len(errs))
+	for i, err := range errs {
+		s[i] = err.Error()
+	}
+	return strings.Join(s, "\n")
+}
+
+// configSource is where the config is loaded from, to locate the errors
+type configSource struct {
+	file string
+	// lines are the lines of the fields, only known for yaml
+	lines map[string]int
+	errs  ConfigErrors
+}
+
+// errorf records the error of the field
+func (s *configSource) errorf(field, format string, args ...interface{}) {
+	s.errs = append(s.errs, &ConfigError{
+		File:  s.file,
+		Line:  s.lines[field],
+		Field: field,
+		Err:   errors.Errorf(format, args...),
+	})
+}
+
+// err returns the recorded errors, and resets them
+func (s *configSource) err() error {
+	errs := s.errs
+	s.errs = nil
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// LoadClientConfig reads the yaml or toml config file into c
+func LoadClientConfig(filename string, c *ClientConfig) error {
+	lines, err := loadConfig(filename, c)
+	c.source = configSource{file: filename, lines: lines}
+	return err
+}
+
+// LoadServerConfig reads the yaml or toml config file into s
+func LoadServerConfig(filename string, s *ServerConfig) error {
+	lines, err := loadConfig(filename, s)
+	s.source = configSource{file: filename, lines: lines}
+	return err
+}
+
+// ConfigFlag returns the value of the -config flag in the command line
+// arguments, so the config file is loaded before the flags override it
+func ConfigFlag(args []string) string {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			return ""
+		}
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		name := strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+		if v, ok := strings.CutPrefix(name, "config="); ok {
+			return v
+		}
+		if name == "config" && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+// loadConfig decodes the config file by its extension, with the environment
+// variables substituted, and returns the lines of the fields
+func loadConfig(filename string, v interface{}) (map[string]int, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read config")
+	}
+
+	switch ext := strings.ToLower(filepath.Ext(filename)); ext {
+	case ".yaml", ".yml":
+		return decodeYAML(filename, b, v)
+	case ".toml":
+		return nil, decodeTOML(filename, b, v)
+	default:
+		return nil, errors.Errorf("config %s should be .yaml, .yml or .toml", filename)
+	}
+}
+
+var yamlErrorRe = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+var yamlUnknownFieldRe = regexp.MustCompile(`^field (\S+) not found in type \S+$`)
+
+func decodeYAML(filename string, b []byte, v interface{}) (map[string]int, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(b, &root); err != nil {
+		return nil, yamlErrors(filename, err)
+	}
+	lines := map[string]int{}
+	if len(root.Content) == 0 {
+		return lines, nil
+	}
+	yamlLines(root.Content[0], "", lines)
+
+	// the unknown fields are checked before the environment variables are
+	// substituted, the other errors are of the substituted values
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(reflect.New(reflect.TypeOf(v).Elem()).Interface()); err != nil {
+		var errs ConfigErrors
+		for _, e := range yamlErrors(filename, err) {
+			if strings.HasPrefix(e.Err.Error(), "unknown field ") {
+				errs = append(errs, e)
+			}
+		}
+		if len(errs) > 0 {
+			return nil, errs
+		}
+	}
+
+	s := &configSource{file: filename, lines: lines}
+	expandYAMLEnv(s, root.Content[0], "")
+	if err := s.err(); err != nil {
+		return nil, err
+	}
+	if err := root.Decode(v); err != nil {
+		return nil, yamlErrors(filename, err)
+	}
+	return lines, nil
+}
+
+// yamlErrors returns the errors of the yaml decoder with their lines
+func yamlErrors(filename string, err error) ConfigErrors {
+	msgs := []string{err.Error()}
+	if te, ok := err.(*yaml.TypeError); ok {
+		msgs = te.Errors
+	}
+	var errs ConfigErrors
+	for _, msg := range msgs {
+		e := &ConfigError{File: filename, Err: errors.New(strings.TrimPrefix(msg, "yaml: "))}
+		if m := yamlErrorRe.FindStringSubmatch(msg); m != nil {
+			e.Line, _ = strconv.Atoi(m[1])
+			e.Err = errors.New(m[2])
+			if m := yamlUnknownFieldRe.FindStringSubmatch(m[2]); m != nil {
+				e.Err = errors.Errorf("unknown field %s", m[1])
+			}
+		}
+		errs = append(errs, e)
+	}
+	return errs
+}
+
+// yamlLines records the lines of the fields under the node
+func yamlLines(node *yaml.Node, path string, lines map[string]int) {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			field := key.Value
+			if path != "" {
+				field = path + "." + key.Value
+			}
+			lines[field] = key.Line
+			yamlLines(node.Content[i+1], field, lines)
+		}
+	case yaml.SequenceNode:
+		for i, item := range node.Content {
+			field := fmt.Sprintf("%s[%d]", path, i)
+			lines[field] = item.Line
+			yamlLines(item, field, lines)
+		}
+	}
+}
+
+// expandYAMLEnv substitutes the environment variables in the values under
+// the node, the plain values are resolved again, e.g. ${PORT} into an int
+func expandYAMLEnv(s *configSource, node *yaml.Node, path string) {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			field := node.Content[i].Value
+			if path != "" {
+				field = path + "." + field
+			}
+			expandYAMLEnv(s, node.Content[i+1], field)
+		}
+	case yaml.SequenceNode:
+		for i, item := range node.Content {
+			expandYAMLEnv(s, item, fmt.Sprintf("%s[%d]", path, i))
+		}
+	case yaml.ScalarNode:
+		value, missing := expandEnv(node.Value)
+		for _, name := range missing {
+			s.errorf(path, "environment variable %s is not set", name)
+		}
+		if value == node.Value {
+			return
+		}
+		node.Value = value
+		if node.Style == 0 {
+			node.Tag = ""
+			if node.ShortTag() == "!!null" {
+				// an empty or null value is still a string
+				node.Tag = "!!str"
+			}
+		}
+	}
+}
+
+func decodeTOML(filename string, b []byte, v interface{}) error {
+	md, err := toml.Decode(string(b), v)
+	if err != nil {
+		if pe, ok := err.(toml.ParseError); ok {
+			return ConfigErrors{{File: filename, Line: pe.Position.Line, Field: pe.LastKey, Err: errors.New(pe.Message)}}
+		}
+		return ConfigErrors{{File: filename, Err: err}}
+	}
+	var errs ConfigErrors
+	for _, key := range md.Undecoded() {
+		errs = append(errs, &ConfigError{File: filename, Field: key.String(), Err: errors.New("unknown field")})
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	s := &configSource{file: filename}
+	expandTOMLEnv(s, reflect.ValueOf(v), "")
+	return s.err()
+}
+
+// expandTOMLEnv substitutes the environment variables in the string fields
+// of the decoded value
+func expandTOMLEnv(s *configSource, v reflect.Value, path string) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			expandTOMLEnv(s, v.Elem(), path)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			field, _, _ := strings.Cut(f.Tag.Get("toml"), ",")
+			if path != "" {
+				field = path + "." + field
+			}
+			expandTOMLEnv(s, v.Field(i), field)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			expandTOMLEnv(s, v.Index(i), fmt.Sprintf("%s[%d]", path, i))
+		}
+	case reflect.String:
+		value, missing := expandEnv(v.String())
+		for _, name := range missing {
+			s.errorf(path, "environment variable %s is not set", name)
+		}
+		v.SetString(value)
+	}
+}
+
+var envRe = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandEnv substitutes ${VAR} or ${VAR:-default} with the environment
+// variables, and $$ with $, and returns the variables not set
+func expandEnv(value string) (string, []string) {
+	var missing []string
+	value = envRe.ReplaceAllStringFunc(value, func(ref string) string {
+		if ref == "$$" {
+			return "$"
+		}
+		m := envRe.FindStringSubmatch(ref)
+		if v, ok := os.LookupEnv(m[1]); ok {
+			return v
+		}
+		if m[2] == "" {
+			missing = append(missing, m[1])
+		}
+		return m[3]
+	})
+	return value, missing
+}
+
+// Validate reports all the invalid values of the config
+func (c *ClientConfig) Validate() error {
+	s := &c.source
+	if c.Server == "" {
+		s.errorf("server", "server address is required")
+	}
+	if c.ServerPort <= 0 || c.ServerPort > 65535 {
+		s.errorf("server_port", "port %d should be 1-65535", c.ServerPort)
+	}
+	if (c.ClientCert == "") != (c.ClientKey == "") {
+		s.errorf("client_cert", "client_cert and client_key should be set together")
+	}
+	if c.ShutdownTimeout < 0 {
+		s.errorf("shutdown_timeout", "duration %s should not be negative", c.ShutdownTimeout)
+	}
+	if c.Inspect != "" {
+		if _, _, err := net.SplitHostPort(c.Inspect); err != nil {
+			s.errorf("inspect", "address %s should be host:port", c.Inspect)
+		}
+	}
+	validateLog(s, c.LogLevel, c.LogFormat)
+	if len(c.Tunnels) == 0 {
+		s.errorf("tunnels", "at least one tunnel is required")
+	}
+
+	domains := map[string]int{}
+	for i, t := range c.Tunnels {
+		field := fmt.Sprintf("tunnels[%d]", i)
+		if t == nil {
+			s.errorf(field, "tunnel is empty")
+			continue
+		}
+		ts := s
+		if t.fromFlags {
+			ts = &configSource{file: "flags"}
+		}
+		if j, ok := domains[strings.ToLower(t.Domain)]; ok && t.Domain != "" {
+			ts.errorf(field+".domain", "domain %s is the same as tunnels[%d]", t.Domain, j)
+		}
+		domains[strings.ToLower(t.Domain)] = i
+		t.validate(ts, field)
+		if ts != s {
+			s.errs = append(s.errs, ts.errs...)
+		}
+	}
+	return s.err()
+}
+
+// AddFlagTunnels adds the tunnels of the command line flags after the ones
+// of the config file, so the errors of the config file keep their lines. A
+// tunnel replaces the one of the config file with the same domain
+func (c *ClientConfig) AddFlagTunnels(tunnels ...*TunnelConfig) {
+	for _, t := range tunnels {
+		t.fromFlags = true
+		replaced := false
+		for i, ft := range c.Tunnels {
+			if t.Domain != "" && ft != nil && !ft.fromFlags && strings.EqualFold(ft.Domain, t.Domain) {
+				c.Tunnels[i], replaced = t, true
+				break
+			}
+		}
+		if !replaced {
+			c.Tunnels = append(c.Tunnels, t)
+		}
+	}
+}
+
+func (t *TunnelConfig) validate(s *configSource, field string) {
+	switch {
+	case t.Serve != nil && (t.Target != "" || len(t.Routes) > 0):
+		s.errorf(field+".serve", "serve could not be used with target or routes")
+	case t.Serve == nil && t.Target == "" && len(t.Routes) == 0:
+		s.errorf(field, "target, routes or serve is required")
+	}
+
+	scheme := "http"
+	if t.Target != "" {
+		u, err := url.Parse(t.Target)
+		switch {
+		case err != nil:
+			s.errorf(field+".target", "target url invalid %s", t.Target)
+		case u.Host == "":
+			s.errorf(field+".target", "target %s should be scheme://host:port", t.Target)
+		default:
+			scheme = u.Scheme
+			switch scheme {
+			case "http", "https", "h2c", "grpc", "tcp", "tls", "udp":
+			default:
+				s.errorf(field+".target", "target scheme %s should be http, https, h2c, grpc, tcp, tls or udp", scheme)
+			}
+		}
+	}
+	if t.Port != 0 {
+		if t.Port < 0 || t.Port > 65535 {
+			s.errorf(field+".port", "port %d should be 1-65535", t.Port)
+		} else if scheme != "tcp" && scheme != "udp" {
+			s.errorf(field+".port", "port is only for tcp and udp targets")
+		}
+	}
+
+	if t.Workers < 0 {
+		s.errorf(field+".workers", "workers %d should not be negative", t.Workers)
+	}
+
+	if len(t.Routes) > 0 {
+		switch scheme {
+		case "http", "https", "h2c", "grpc":
+		default:
+			s.errorf(field+".target", "target of the routes should be http, https, h2c or grpc")
+		}
+	}
+	for j, r := range t.Routes {
+		rf := fmt.Sprintf("%s.routes[%d]", field, j)
+		if r.Path != "" && r.Regexp != "" {
+			s.errorf(rf, "path and regexp are exclusive")
+		}
+		if r.Regexp != "" {
+			if _, err := regexp.Compile(r.Regexp); err != nil {
+				s.errorf(rf+".regexp", "%v", err)
+			}
+		}
+		if r.Target == "" {
+			s.errorf(rf, "target is required")
+			continue
+		}
+		u, err := url.Parse(r.Target)
+		if err != nil || u.Host == "" {
+			s.errorf(rf+".target", "target %s should be scheme://host:port", r.Target)
+			continue
+		}
+		switch u.Scheme {
+		case "http", "https", "h2c", "grpc":
+		default:
+			s.errorf(rf+".target", "target scheme %s should be http, https, h2c or grpc", u.Scheme)
+		}
+	}
+
+	if t.Serve != nil {
+		if t.Serve.Dir == "" {
+			s.errorf(field+".serve.dir", "dir is required")
+		} else if fi, err := os.Stat(t.Serve.Dir); err != nil || !fi.IsDir() {
+			s.errorf(field+".serve.dir", "%s is not a directory", t.Serve.Dir)
+		}
+		if t.Serve.BasicAuth != "" {
+			if user, _, ok := strings.Cut(t.Serve.BasicAuth, ":"); !ok || user == "" {
+				s.errorf(field+".serve.basic_auth", "basic_auth should be user:password")
+			}
+		}
+	}
+}
+
+// NewClient validates the config, and returns the client of it
+func (c *ClientConfig) NewClient() (*Client, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	client := &Client{
+		Server:         c.Server,
+		ServerPort:     c.ServerPort,
+		CertFile:       c.Cert,
+		Insecure:       c.Insecure,
+		ClientCertFile: c.ClientCert,
+		ClientKeyFile:  c.ClientKey,
+		AuthKey:        c.AuthKey,
+	}
+	client.Logger, _ = newLogger(os.Stderr, c.LogLevel, c.LogFormat)
+	if c.Inspect != "" || c.HAROut != "" {
+		client.Inspector = &Inspector{}
+	}
+	for _, tc := range c.Tunnels {
+		t := &Tunnel{
+			Domain:     tc.Domain,
+			RemotePort: tc.Port,
+			Workers:    tc.Workers,
+		}
+		switch {
+		case tc.Serve != nil:
+			files := &FileServer{Dir: tc.Serve.Dir, Listing: tc.Serve.Listing, SPA: tc.Serve.SPA, Dotfiles: tc.Serve.Dotfiles}
+			files.Username, files.Password, _ = strings.Cut(tc.Serve.BasicAuth, ":")
+			t.handler = files
+		case len(tc.Routes) > 0:
+			t.Routes = append([]Route(nil), tc.Routes...)
+			if tc.Target != "" {
+				// the target is the last route
+				t.Routes = append(t.Routes, Route{Target: tc.Target})
+			}
+		default:
+			t.Target = tc.Target
+		}
+		client.Tunnels = append(client.Tunnels, t)
+	}
+	return client, nil
+}
+
+// Validate reports all the invalid values of the config
+func (c *ServerConfig) Validate() error {
+	s := &c.source
+	addrs := []struct{ field, addr string }{
+		{"listen", c.Listen}, {"http", c.HTTP}, {"https", c.HTTPS}, {"tls", c.TLS},
+	}
+	for _, a := range addrs {
+		if a.addr == "" {
+			continue
+		}
+		if _, port, err := net.SplitHostPort(a.addr); err != nil {
+			s.errorf(a.field, "address %s should be host:port", a.addr)
+		} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			s.errorf(a.field, "port %s of %s invalid", port, a.addr)
+		}
+	}
+	if c.Listen == "" {
+		s.errorf("listen", "listen address is required")
+	}
+	if len(c.HTTPSCertFiles) != len(c.HTTPSKeyFiles) {
+		s.errorf("https_key_files", "%d key files should match the %d cert files", len(c.HTTPSKeyFiles), len(c.HTTPSCertFiles))
+	}
+	if c.HTTPS != "" && len(c.HTTPSCertFiles) == 0 && !c.ACME.Enabled {
+		s.errorf("https", "https requires https_cert_files or acme")
+	}
+	if (c.Cert == "") != (c.Key == "") {
+		s.errorf("cert", "cert and key should be set together")
+	}
+	durations := []struct {
+		field string
+		d     time.Duration
+	}{
+		{"wait_timeout", c.WaitTimeout},
+		{"upgrade_idle_timeout", c.UpgradeIdleTimeout},
+		{"shutdown_timeout", c.ShutdownTimeout},
+	}
+	for _, d := range durations {
+		if d.d < 0 {
+			s.errorf(d.field, "duration %s should not be negative", d.d)
+		}
+	}
+	if _, _, err := parsePortRange(c.TCPPorts); err != nil {
+		s.errorf("tcp_ports", "%v", err)
+	}
+	if c.AuthKeys != "" {
+		if _, err := LoadAPIKeys(c.AuthKeys); err != nil {
+			s.errorf("auth_keys", "%v", err)
+		}
+	}
+	if c.ACME.Enabled {
+		if c.HTTPS == "" {
+			s.errorf("acme.enabled", "acme requires https")
+		}
+		if c.ACME.DNSHook != "" && c.ACME.Domain == "" && len(c.DomainSuffixes) == 0 {
+			s.errorf("acme.dns_hook", "dns_hook requires acme.domain or domain_suffixes")
+		}
+	}
+	if f := c.AccessLogFormat; f != "" && f != AccessLogCombined && f != AccessLogJSON {
+		s.errorf("access_log_format", "access log format %s should be combined or json", f)
+	}
+	validateLog(s, c.LogLevel, c.LogFormat)
+	return s.err()
+}
+
+// NewServer validates the config, and returns the server of it
+func (c *ServerConfig) NewServer() (*Server, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	server := &Server{
+		GRPCAddr:       c.Listen,
+		HTTPAddr:       c.HTTP,
+		HTTPSAddr:      c.HTTPS,
+		HTTPSCertFiles: c.HTTPSCertFiles,
+		HTTPSKeyFiles:  c.HTTPSKeyFiles,
+		TLSAddr:        c.TLS,
+		CertFile:       c.Cert,
+		KeyFile:        c.Key,
+		ClientCAFile:   c.ClientCA,
+		WaitTimeout:    c.WaitTimeout,
+		TCPHost:        c.TCPHost,
+
+		UpgradeIdleTimeout: c.UpgradeIdleTimeout,
+		Policy: &RegisterPolicy{
+			Suffixes: lowerList(c.DomainSuffixes),
+			Reserved: lowerList(c.Reserved),
+		},
+	}
+	server.TCPPortMin, server.TCPPortMax, _ = parsePortRange(c.TCPPorts)
+	server.Logger, _ = newLogger(os.Stderr, c.LogLevel, c.LogFormat)
+
+	if c.ACME.Enabled {
+		server.ACME = &ACMEConfig{
+			DirectoryURL: c.ACME.Directory,
+			Email:        c.ACME.Email,
+			CacheDir:     c.ACME.Cache,
+			BaseDomain:   c.ACME.Domain,
+		}
+		if server.ACME.BaseDomain == "" && len(server.Policy.Suffixes) > 0 {
+			server.ACME.BaseDomain = server.Policy.Suffixes[0]
+		}
+		if c.ACME.DNSHook != "" {
+			server.ACME.DNSHook = CommandDNSHook(c.ACME.DNSHook)
+		}
+	}
+
+	if c.AuthKeys != "" {
+		keys, err := LoadAPIKeys(c.AuthKeys)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not load api keys")
+		}
+		server.APIKeys = keys
+	}
+
+	switch c.AccessLog {
+	case "":
+	case "-":
+		server.AccessLog = &AccessLog{Format: c.AccessLogFormat, Writer: os.Stdout}
+	default:
+		f, err := OpenLogFile(c.AccessLog)
+		if err != nil {
+			return nil, err
+		}
+		server.AccessLog = &AccessLog{Format: c.AccessLogFormat, Writer: f}
+	}
+	return server, nil
+}
+
+func validateLog(s *configSource, level, format string) {
+	if _, err := parseLogLevel(level); err != nil {
+		s.errorf("log_level", "log level %s should be debug, info, warn or error", level)
+	}
+	if format != "" && format != "text" && format != "json" {
+		s.errorf("log_format", "log format %s should be text or json", format)
+	}
+}
+
+// parseLogLevel returns the level of the name, info if empty
+func parseLogLevel(level string) (slog.Level, error) {
+	var l slog.Level
+	if level == "" {
+		return l, nil
+	}
+	err := l.UnmarshalText([]byte(level))
+	return l, err
+}
+
+// newLogger returns the logger writing to w at the level in the format,
+// which is text or json, info and text if empty
+func newLogger(w io.Writer, level, format string) (*slog.Logger, error) {
+	l, err := parseLogLevel(level)
+	if err != nil {
+		return nil, errors.Errorf("invalid log level %s", level)
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	switch format {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, errors.Errorf("invalid log format %s", format)
+}
+
+// lowerList returns the lower case of the non-empty values
+func lowerList(list []string) []string {
+	var lower []string
+	for _, v := range list {
+		if v = strings.TrimSpace(v); v != "" {
+			lower = append(lower, strings.ToLower(v))
+		}
+	}
+	return lower
+}
+
+// parsePortRange parses the port range, e.g. 20000-20999
+func parsePortRange(s string) (min, max int, err error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	lo, hi, found := strings.Cut(s, "-")
+	if !found {
+		hi = lo
+	}
+	if min, err = strconv.Atoi(strings.TrimSpace(lo)); err != nil {
+		return 0, 0, errors.Errorf("invalid port range %s", s)
+	}
+	if max, err = strconv.Atoi(strings.TrimSpace(hi)); err != nil {
+		return 0, 0, errors.Errorf("invalid port range %s", s)
+	}
+	if min <= 0 || max > 65535 || min > max {
+		return 0, 0, errors.Errorf("invalid port range %s", s)
+	}
+	return min, max, nil
+}
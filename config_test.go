@@ -0,0 +1,477 @@
+package hypro
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes the config file, and returns its path
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+const clientYAML = `
+server: hypro.example.com
+auth_key: ${HYPRO_TEST_KEY}
+shutdown_timeout: 5s
+tunnels:
+  - domain: web.example.com
+    target: http://localhost:3000
+    routes:
+      - path: /api/
+        target: http://localhost:8080
+        strip_prefix: true
+  - domain: db.example.com
+    target: tcp://localhost:5432
+    port: 15432
+    workers: ${HYPRO_TEST_WORKERS:-4}
+`
+
+const clientTOML = `
+server = "hypro.example.com"
+auth_key = "${HYPRO_TEST_KEY}"
+shutdown_timeout = "5s"
+
+[[tunnels]]
+domain = "web.example.com"
+target = "http://localhost:3000"
+
+[[tunnels.routes]]
+path = "/api/"
+target = "http://localhost:8080"
+strip_prefix = true
+
+[[tunnels]]
+domain = "db.example.com"
+target = "tcp://${HYPRO_TEST_DB_HOST:-localhost}:5432"
+port = 15432
+workers = 4
+`
+
+func TestLoadClientConfig(t *testing.T) {
+	t.Setenv("HYPRO_TEST_KEY", "secret")
+	want := &ClientConfig{
+		Server:          "hypro.example.com",
+		ServerPort:      49776,
+		AuthKey:         "secret",
+		ShutdownTimeout: 5 * time.Second,
+		Inspect:         "127.0.0.1:4040",
+		LogLevel:        "info",
+		LogFormat:       "text",
+		Tunnels: []*TunnelConfig{
+			{
+				Domain: "web.example.com",
+				Target: "http://localhost:3000",
+				Routes: []Route{{Path: "/api/", Target: "http://localhost:8080", StripPrefix: true}},
+			},
+			{Domain: "db.example.com", Target: "tcp://localhost:5432", Port: 15432, Workers: 4},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"hypro.yaml", clientYAML},
+		{"hypro.toml", clientTOML},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultClientConfig()
+			if err := LoadClientConfig(writeConfig(t, tt.name, tt.content), c); err != nil {
+				t.Fatalf("LoadClientConfig() error = %v", err)
+			}
+			c.source = configSource{}
+			if !reflect.DeepEqual(c, want) {
+				t.Errorf("LoadClientConfig() = %+v, want %+v", c, want)
+			}
+		})
+	}
+}
+
+func TestLoadClientConfig_env(t *testing.T) {
+	// the values could not change the structure of the file
+	const secret = "a: b # c\n'\"[d]"
+	t.Setenv("HYPRO_TEST_KEY", secret)
+	t.Setenv("HYPRO_TEST_PORT", "1234")
+	t.Setenv("HYPRO_TEST_EMPTY", "")
+
+	tests := []struct {
+		name    string
+		content string
+		want    *ClientConfig
+	}{
+		{
+			"hypro.yaml",
+			"# ${HYPRO_TEST_UNSET} in a comment\nserver: ${HYPRO_TEST_EMPTY}\nserver_port: ${HYPRO_TEST_PORT}\nauth_key: ${HYPRO_TEST_KEY}\ncert: \"$${HYPRO_TEST_KEY}\"\n",
+			&ClientConfig{ServerPort: 1234, AuthKey: secret, Cert: "${HYPRO_TEST_KEY}"},
+		},
+		{
+			"hypro.toml",
+			"# ${HYPRO_TEST_UNSET} in a comment\nserver = \"${HYPRO_TEST_EMPTY}\"\nauth_key = \"${HYPRO_TEST_KEY}\"\ncert = \"$${HYPRO_TEST_KEY}\"\n",
+			&ClientConfig{AuthKey: secret, Cert: "${HYPRO_TEST_KEY}"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &ClientConfig{}
+			if err := LoadClientConfig(writeConfig(t, tt.name, tt.content), c); err != nil {
+				t.Fatalf("LoadClientConfig() error = %v", err)
+			}
+			c.source = configSource{}
+			if !reflect.DeepEqual(c, tt.want) {
+				t.Errorf("LoadClientConfig() = %+v, want %+v", c, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadClientConfig_errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{
+			"unknown.yaml",
+			"server: a\ntunnels:\n  - domain: a\n    targte: http://localhost\n",
+			[]string{":4: unknown field targte"},
+		},
+		{
+			"type.yaml",
+			"server: a\nserver_port: abc\n",
+			[]string{":2: cannot unmarshal !!str `abc` into int"},
+		},
+		{
+			"syntax.yaml",
+			"server: a\n  b: c\n",
+			[]string{":2: mapping values are not allowed in this context"},
+		},
+		{
+			"env.yaml",
+			"server: a\nauth_key: ${HYPRO_TEST_UNSET}\n",
+			[]string{":2: auth_key: environment variable HYPRO_TEST_UNSET is not set"},
+		},
+		{
+			"env.toml",
+			"server = \"a\"\n[[tunnels]]\ntarget = \"http://${HYPRO_TEST_UNSET}\"\n",
+			[]string{": tunnels[0].target: environment variable HYPRO_TEST_UNSET is not set"},
+		},
+		{
+			"unknown.toml",
+			"server = \"a\"\n[[tunnels]]\ndomain = \"a\"\ntargte = \"http://localhost\"\n",
+			[]string{": tunnels.targte: unknown field"},
+		},
+		{
+			"syntax.toml",
+			"server = \"a\"\nserver_port = \n",
+			[]string{":2: "},
+		},
+		{
+			"hypro.json",
+			"{}",
+			[]string{" should be .yaml, .yml or .toml"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := LoadClientConfig(writeConfig(t, tt.name, tt.content), DefaultClientConfig())
+			if err == nil {
+				t.Fatal("LoadClientConfig() error = nil")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), tt.name+want) {
+					t.Errorf("LoadClientConfig() error = %v, want %s%s", err, tt.name, want)
+				}
+			}
+		})
+	}
+}
+
+func TestClientConfig_Validate(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{"Valid", clientYAML, nil},
+		{
+			"Required",
+			"server_port: 0\nlog_level: verbose\nlog_format: xml\n",
+			[]string{
+				"server: server address is required",
+				":1: server_port: port 0 should be 1-65535",
+				":2: log_level: log level verbose should be debug, info, warn or error",
+				":3: log_format: log format xml should be text or json",
+				"tunnels: at least one tunnel is required",
+			},
+		},
+		{
+			"Tunnels",
+			`server: a
+tunnels:
+  - domain: a.example.com
+  - domain: A.example.com
+    target: ftp://localhost
+  - target: http://localhost:8080
+    port: 8000
+  - target: udp://localhost:53
+    routes:
+      - regexp: "("
+        target: http://localhost
+      - path: /
+        target: tcp://localhost:22
+  - serve:
+      dir: ` + dir + `/missing
+      basic_auth: nopassword
+`,
+			[]string{
+				":3: tunnels[0]: target, routes or serve is required",
+				":4: tunnels[1].domain: domain A.example.com is the same as tunnels[0]",
+				":5: tunnels[1].target: target scheme ftp should be",
+				":7: tunnels[2].port: port is only for tcp and udp targets",
+				":8: tunnels[3].target: target of the routes should be http, https, h2c or grpc",
+				":10: tunnels[3].routes[0].regexp: error parsing regexp",
+				":13: tunnels[3].routes[1].target: target scheme tcp should be http, https, h2c or grpc",
+				":15: tunnels[4].serve.dir: " + dir + "/missing is not a directory",
+				":16: tunnels[4].serve.basic_auth: basic_auth should be user:password",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("HYPRO_TEST_KEY", "secret")
+			file := writeConfig(t, "hypro.yaml", tt.content)
+			c := DefaultClientConfig()
+			if err := LoadClientConfig(file, c); err != nil {
+				t.Fatalf("LoadClientConfig() error = %v", err)
+			}
+			err := c.Validate()
+			if tt.want == nil {
+				if err != nil {
+					t.Errorf("Validate() error = %v", err)
+				}
+				return
+			}
+			errs, ok := err.(ConfigErrors)
+			if !ok || len(errs) != len(tt.want) {
+				t.Fatalf("Validate() error = %v, want %d errors", err, len(tt.want))
+			}
+			for i, want := range tt.want {
+				if got := errs[i].Error(); !strings.HasPrefix(got, file+want) && !strings.HasPrefix(got, file+": "+want) {
+					t.Errorf("Validate() error[%d] = %s, want %s", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestClientConfig_AddFlagTunnels(t *testing.T) {
+	file := writeConfig(t, "hypro.yaml", `server: a
+tunnels:
+  - domain: web.example.com
+    target: http://localhost:3000
+  - domain: api.example.com
+    target: ftp://localhost
+`)
+	c := DefaultClientConfig()
+	if err := LoadClientConfig(file, c); err != nil {
+		t.Fatal(err)
+	}
+	web := &TunnelConfig{Domain: "WEB.example.com", Target: "http://localhost:4000"}
+	c.AddFlagTunnels(web, &TunnelConfig{Domain: "db.example.com", Target: "tcp://localhost:5432", Workers: -1})
+
+	var domains []string
+	for _, t := range c.Tunnels {
+		domains = append(domains, t.Domain)
+	}
+	if want := []string{"WEB.example.com", "api.example.com", "db.example.com"}; !reflect.DeepEqual(domains, want) || c.Tunnels[0] != web {
+		t.Errorf("Tunnels = %v, want %v with the flag tunnel first", domains, want)
+	}
+
+	want := file + ":6: tunnels[1].target: target scheme ftp should be http, https, h2c, grpc, tcp, tls or udp\n" +
+		"flags: tunnels[2].workers: workers -1 should not be negative"
+	if err := c.Validate(); err == nil || err.Error() != want {
+		t.Errorf("Validate() error = %v, want %s", err, want)
+	}
+}
+
+func TestClientConfig_NewClient(t *testing.T) {
+	dir := t.TempDir()
+	c := &ClientConfig{
+		Server:     "hypro.example.com",
+		ServerPort: 49776,
+		Tunnels: []*TunnelConfig{
+			{Domain: "web", Target: "http://localhost:3000", Routes: []Route{{Path: "/api/", Target: "http://localhost:8080"}}},
+			{Domain: "files", Serve: &ServeConfig{Dir: dir, SPA: true, BasicAuth: "u:p:q"}},
+			{Domain: "db", Target: "tcp://localhost:5432", Port: 15432},
+		},
+	}
+	client, err := c.NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(client.Tunnels) != 3 {
+		t.Fatalf("Tunnels = %v, want 3", client.Tunnels)
+	}
+	wantRoutes := []Route{{Path: "/api/", Target: "http://localhost:8080"}, {Target: "http://localhost:3000"}}
+	if got := client.Tunnels[0].Routes; !reflect.DeepEqual(got, wantRoutes) {
+		t.Errorf("Tunnels[0].Routes = %v, want %v", got, wantRoutes)
+	}
+	wantFiles := &FileServer{Dir: dir, SPA: true, Username: "u", Password: "p:q"}
+	if got := client.Tunnels[1].handler; !reflect.DeepEqual(got, wantFiles) {
+		t.Errorf("Tunnels[1].handler = %v, want %v", got, wantFiles)
+	}
+	if got := client.Tunnels[2]; got.Target != "tcp://localhost:5432" || got.RemotePort != 15432 {
+		t.Errorf("Tunnels[2] = %+v", got)
+	}
+}
+
+func TestServerConfig_NewServer(t *testing.T) {
+	file := writeConfig(t, "hypro-server.toml", `
+listen = ":49776"
+http = ":8080"
+domain_suffixes = ["Example.com"]
+tcp_ports = "20000-20999"
+upgrade_idle_timeout = "1m"
+
+[acme]
+enabled = true
+`)
+	c := DefaultServerConfig()
+	if err := LoadServerConfig(file, c); err != nil {
+		t.Fatal(err)
+	}
+	c.HTTPS = ":8443"
+	s, err := c.NewServer()
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	if s.HTTPAddr != ":8080" || s.HTTPSAddr != ":8443" || s.UpgradeIdleTimeout != time.Minute {
+		t.Errorf("NewServer() = %+v", s)
+	}
+	if !reflect.DeepEqual(s.Policy.Suffixes, []string{"example.com"}) || !reflect.DeepEqual(s.Policy.Reserved, []string{"www", "api", "admin"}) {
+		t.Errorf("NewServer() Policy = %+v", s.Policy)
+	}
+	if s.TCPPortMin != 20000 || s.TCPPortMax != 20999 {
+		t.Errorf("NewServer() TCP ports = %d-%d", s.TCPPortMin, s.TCPPortMax)
+	}
+	if s.ACME == nil || s.ACME.BaseDomain != "example.com" || s.ACME.CacheDir != "acme-cache" {
+		t.Errorf("NewServer() ACME = %+v", s.ACME)
+	}
+
+	t.Run("Invalid", func(t *testing.T) {
+		c := DefaultServerConfig()
+		c.HTTP = "localhost"
+		c.TCPPorts = "2000-1000"
+		c.HTTPSCertFiles = []string{"a.crt"}
+		c.AccessLogFormat = "common"
+		want := "http: address localhost should be host:port\n" +
+			"https_key_files: 0 key files should match the 1 cert files\n" +
+			"tcp_ports: invalid port range 2000-1000\n" +
+			"access_log_format: access log format common should be combined or json"
+		if _, err := c.NewServer(); err == nil || err.Error() != want {
+			t.Errorf("NewServer() error = %v, want %s", err, want)
+		}
+	})
+}
+
+func TestConfigFlag(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-config", "a.yaml"}, "a.yaml"},
+		{[]string{"--config=a.yaml"}, "a.yaml"},
+		{[]string{"-server", "example.com", "-config", "a.yaml"}, "a.yaml"},
+		{[]string{"-server", "example.com"}, ""},
+		{[]string{"config", "validate", "a.yaml"}, ""},
+		{[]string{"--", "-config", "a.yaml"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			if got := ConfigFlag(tt.args); got != tt.want {
+				t.Errorf("ConfigFlag() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_newLogger(t *testing.T) {
+	tests := []struct {
+		level, format string
+		want          string
+		wantErr       bool
+	}{
+		{"", "", "level=INFO msg=info host=a\n", false},
+		{"debug", "text", "level=DEBUG msg=debug host=a\nlevel=INFO msg=info host=a\n", false},
+		{"WARN", "json", "", false},
+		{"info", "json", `{"level":"INFO","msg":"info","host":"a"}` + "\n", false},
+		{"verbose", "text", "", true},
+		{"info", "xml", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level+" "+tt.format, func(t *testing.T) {
+			var buf strings.Builder
+			logger, err := newLogger(&buf, tt.level, tt.format)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newLogger() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			// drops the time to compare
+			logger = slog.New(&noTimeHandler{logger.Handler()})
+			logger.Debug("debug", "host", "a")
+			logger.Info("info", "host", "a")
+			if got := buf.String(); got != tt.want {
+				t.Errorf("newLogger() logged %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// noTimeHandler logs the records without the time
+type noTimeHandler struct {
+	slog.Handler
+}
+
+func (h *noTimeHandler) Handle(ctx context.Context, r slog.Record) error {
+	r.Time = time.Time{}
+	return h.Handler.Handle(ctx, r)
+}
+
+func Test_parsePortRange(t *testing.T) {
+	tests := []struct {
+		s        string
+		min, max int
+		wantErr  bool
+	}{
+		{"", 0, 0, false},
+		{"20000-20999", 20000, 20999, false},
+		{"8000", 8000, 8000, false},
+		{"2000-1000", 0, 0, true},
+		{"0-10", 0, 0, true},
+		{"a-b", 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			min, max, err := parsePortRange(tt.s)
+			if (err != nil) != tt.wantErr || min != tt.min || max != tt.max {
+				t.Errorf("parsePortRange() = %d, %d, %v, want %d, %d, wantErr %v", min, max, err, tt.min, tt.max, tt.wantErr)
+			}
+		})
+	}
+}
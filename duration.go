@@ -0,0 +1,8 @@
+package hypro
+
+import "time"
+
+// millis returns d in milliseconds, as the timings of the HAR and the access log
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
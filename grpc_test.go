@@ -0,0 +1,123 @@
+package hypro
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	pb "github.com/chuangbo/hypro/protos"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// echoTunnelServer echoes the packets of CreateTunnel with a trailer
+type echoTunnelServer struct {
+	pb.UnimplementedTunnelServer
+}
+
+func (echoTunnelServer) CreateTunnel(stream pb.Tunnel_CreateTunnelServer) error {
+	n := 0
+	for {
+		p, err := stream.Recv()
+		if err == io.EOF {
+			stream.SetTrailer(metadata.Pairs("echoed", strconv.Itoa(n)))
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		n++
+		if err := stream.Send(p); err != nil {
+			return err
+		}
+	}
+}
+
+func TestClient_grpcTarget(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := grpc.NewServer()
+	healthServer := health.NewServer()
+	healthpb.RegisterHealthServer(target, healthServer)
+	pb.RegisterTunnelServer(target, echoTunnelServer{})
+	go target.Serve(lis)
+	defer target.Stop()
+
+	const domain = "grpc.localhost"
+	s := startTunnel(t, domain, "grpc://"+lis.Addr().String(), nil)
+
+	conn, err := grpc.NewClient(s.HTTPAddr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithAuthority(domain),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	hc := healthpb.NewHealthClient(conn)
+
+	t.Run("Unary", func(t *testing.T) {
+		r, err := hc.Check(ctx, &healthpb.HealthCheckRequest{})
+		if err != nil || r.Status != healthpb.HealthCheckResponse_SERVING {
+			t.Errorf("Check() = %v, %v, want SERVING", r, err)
+		}
+	})
+
+	t.Run("Status in trailers", func(t *testing.T) {
+		_, err := hc.Check(ctx, &healthpb.HealthCheckRequest{Service: "unknown"})
+		if status.Code(err) != codes.NotFound {
+			t.Errorf("Check() error = %v, want %v", err, codes.NotFound)
+		}
+	})
+
+	t.Run("Server streaming", func(t *testing.T) {
+		healthServer.SetServingStatus("app", healthpb.HealthCheckResponse_SERVING)
+		stream, err := hc.Watch(ctx, &healthpb.HealthCheckRequest{Service: "app"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r, err := stream.Recv(); err != nil || r.Status != healthpb.HealthCheckResponse_SERVING {
+			t.Fatalf("Recv() = %v, %v, want SERVING", r, err)
+		}
+		// the update arrives while the stream is open
+		healthServer.SetServingStatus("app", healthpb.HealthCheckResponse_NOT_SERVING)
+		if r, err := stream.Recv(); err != nil || r.Status != healthpb.HealthCheckResponse_NOT_SERVING {
+			t.Errorf("Recv() = %v, %v, want NOT_SERVING", r, err)
+		}
+	})
+
+	t.Run("Bidi streaming", func(t *testing.T) {
+		stream, err := pb.NewTunnelClient(conn).CreateTunnel(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			want := []byte{byte(i)}
+			if err := stream.Send(&pb.Packet{Data: want}); err != nil {
+				t.Fatalf("Send() error = %v", err)
+			}
+			if p, err := stream.Recv(); err != nil || string(p.Data) != string(want) {
+				t.Fatalf("Recv() = %v, %v, want %v", p, err, want)
+			}
+		}
+		stream.CloseSend()
+		if _, err := stream.Recv(); err != io.EOF {
+			t.Fatalf("Recv() error = %v, want EOF", err)
+		}
+		if got := stream.Trailer().Get("echoed"); len(got) != 1 || got[0] != "3" {
+			t.Errorf("Trailer() echoed = %v, want 3", got)
+		}
+	})
+}
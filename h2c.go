@@ -0,0 +1,108 @@
+package hypro
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// h2cReadIdleTimeout pings the h2c connections without frames, so the
+// broken tunnels are detected
+const h2cReadIdleTimeout = 30 * time.Second
+
+// h2cRoundTripper sends the requests to the clients serving h2c with the h2c
+// transport, which carries all of them over one tunnel connection
+type h2cRoundTripper struct {
+	server         *Server
+	transport, h2c http.RoundTripper
+}
+
+func (t *h2cRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	if t.server.h2cEnabled(r.URL.Host) {
+		return t.h2c.RoundTrip(r)
+	}
+	return t.transport.RoundTrip(r)
+}
+
+// makeH2CTransport returns the transport speaking h2c with prior knowledge
+// over the tunnel connections
+func (s *Server) makeH2CTransport() *http2.Transport {
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return s.DialContext(ctx, network, addr)
+		},
+		ReadIdleTimeout: h2cReadIdleTimeout,
+	}
+}
+
+// newH2CTargetTransport returns the transport speaking h2c with prior
+// knowledge to the target, which keeps the trailers and the streaming
+// bodies of gRPC
+func newH2CTargetTransport() *http2.Transport {
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// h2cEnabled reports whether the client of the host serves h2c
+func (s *Server) h2cEnabled(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c, ok := s.users[strings.ToLower(host)]
+	return ok && c.h2c
+}
+
+// h2cServer serves both HTTP/1.1 and h2c with prior knowledge on the tunnel
+// connections. Shutdown also waits for the requests of the h2c connections,
+// which are hijacked from http.Server and not tracked by it
+type h2cServer struct {
+	*http.Server
+	requests atomic.Int64
+}
+
+func newH2CServer(handler http.Handler) (*h2cServer, error) {
+	s := &h2cServer{Server: &http.Server{}}
+	h2s := &http2.Server{}
+	// sends GOAWAY to the h2c connections on Shutdown
+	if err := http2.ConfigureServer(s.Server, h2s); err != nil {
+		return nil, err
+	}
+	s.Handler = h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.requests.Add(1)
+		defer s.requests.Add(-1)
+		handler.ServeHTTP(w, r)
+	}), h2s)
+	return s, nil
+}
+
+// Shutdown closes the listener and waits for all the requests until ctx is done
+func (s *h2cServer) Shutdown(ctx context.Context) error {
+	if err := s.Server.Shutdown(ctx); err != nil {
+		return err
+	}
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for s.requests.Load() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
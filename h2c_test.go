@@ -0,0 +1,117 @@
+package hypro
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestServer_h2c(t *testing.T) {
+	const n = 20
+	// the target holds the requests until all of them arrived
+	var arrived sync.WaitGroup
+	arrived.Add(n)
+	release := make(chan struct{})
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived.Done()
+		<-release
+		fmt.Fprint(w, "ok")
+	}))
+	defer target.Close()
+
+	const domain = "h2c.localhost"
+	s := startTunnel(t, domain, target.URL, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", "http://"+s.HTTPAddr+"/", nil)
+			req.Host = domain
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Errorf("Do() error = %v", err)
+				return
+			}
+			defer resp.Body.Close()
+			if b, _ := io.ReadAll(resp.Body); string(b) != "ok" {
+				t.Errorf("body = %q, want ok", b)
+			}
+		}()
+	}
+
+	arrived.Wait()
+	s.mu.RLock()
+	c := s.users[domain]
+	s.mu.RUnlock()
+	c.mu.RLock()
+	got := c.activeSession().numConns()
+	c.mu.RUnlock()
+	close(release)
+	wg.Wait()
+
+	if got != 1 {
+		t.Errorf("tunnel connections = %d, want 1 carrying all the %d requests", got, n)
+	}
+}
+
+// writeTestCert writes the certificate and key as pem files
+func writeTestCert(t *testing.T, cert *tls.Certificate) (certFile, keyFile string) {
+	t.Helper()
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	der, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestServer_https_http2(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("X-Forwarded-Proto"))
+	}))
+	defer target.Close()
+
+	const domain = "h2.localhost"
+	cert := newTestCert(t, domain)
+	certFile, keyFile := writeTestCert(t, cert)
+	s := startTunnel(t, domain, target.URL, func(s *Server) {
+		s.HTTPSAddr = fmt.Sprintf("127.0.0.1:%d", freePort(t))
+		s.HTTPSCertFiles, s.HTTPSKeyFiles = []string{certFile}, []string{keyFile}
+	})
+	waitForListener(t, s.HTTPSAddr)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots, ServerName: domain},
+		ForceAttemptHTTP2: true,
+	}}
+	req, _ := http.NewRequest("GET", "https://"+s.HTTPSAddr+"/", nil)
+	req.Host = domain
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Do() error = %v", err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	if resp.ProtoMajor != 2 || string(b) != "https" {
+		t.Errorf("response = %s %q, want HTTP/2.0 https", resp.Proto, b)
+	}
+}
@@ -0,0 +1,308 @@
+package hypro
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// the HAR 1.2 format, http://www.softwareishard.com/blog/har-12-spec/
+
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+	// the custom fields of the time spent on the tunnel and the local target
+	Tunnel float64 `json:"_tunnel"`
+	Target float64 `json:"_target"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harCookie    `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+	Comment     string         `json:"comment,omitempty"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harCookie    `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+	Comment     string         `json:"comment,omitempty"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harCookie struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Path     string `json:"path,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	Expires  string `json:"expires,omitempty"`
+	HTTPOnly bool   `json:"httpOnly,omitempty"`
+	Secure   bool   `json:"secure,omitempty"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+// WriteHAR writes the exchanges in the HAR 1.2 format, the oldest first
+func WriteHAR(w io.Writer, exchanges []*Exchange) error {
+	har := harFile{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "hypro", Version: Version},
+		Entries: make([]harEntry, 0, len(exchanges)),
+	}}
+	for _, e := range exchanges {
+		har.Log.Entries = append(har.Log.Entries, newHAREntry(e))
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(har)
+}
+
+// WriteHAR writes the recorded exchanges in the HAR 1.2 format
+func (i *Inspector) WriteHAR(w io.Writer) error {
+	list := i.Exchanges()
+	for l, r := 0, len(list)-1; l < r; l, r = l+1, r-1 {
+		list[l], list[r] = list[r], list[l]
+	}
+	return WriteHAR(w, list)
+}
+
+// HARWriter streams the exchanges to a HAR 1.2 file as they are recorded,
+// the file is complete once it is closed
+type HARWriter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	n   int
+	err error
+}
+
+// NewHARWriter starts the HAR file on w
+func NewHARWriter(w io.Writer) (*HARWriter, error) {
+	creator, err := json.Marshal(harCreator{Name: "hypro", Version: Version})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(w, "{\n  \"log\": {\n    \"version\": \"1.2\",\n    \"creator\": %s,\n    \"entries\": [", creator); err != nil {
+		return nil, errors.Wrap(err, "could not write the HAR file")
+	}
+	return &HARWriter{w: w}, nil
+}
+
+// Write appends the exchange to the entries, it returns the first error of
+// the writes if any
+func (hw *HARWriter) Write(e *Exchange) error {
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+	if hw.err != nil {
+		return hw.err
+	}
+	b, err := json.MarshalIndent(newHAREntry(e), "      ", "  ")
+	if err != nil {
+		return err
+	}
+	sep := ","
+	if hw.n == 0 {
+		sep = ""
+	}
+	if _, err := fmt.Fprintf(hw.w, "%s\n      %s", sep, b); err != nil {
+		hw.err = errors.Wrap(err, "could not write the HAR file")
+		return hw.err
+	}
+	hw.n++
+	return nil
+}
+
+// Close ends the entries and the file, it does not close the underlying
+// writer
+func (hw *HARWriter) Close() error {
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+	if hw.err != nil {
+		return hw.err
+	}
+	end := "\n    ]\n  }\n}\n"
+	if hw.n == 0 {
+		end = "]\n  }\n}\n"
+	}
+	if _, err := io.WriteString(hw.w, end); err != nil {
+		hw.err = errors.Wrap(err, "could not write the HAR file")
+	}
+	return hw.err
+}
+
+func newHAREntry(e *Exchange) harEntry {
+	req, resp := e.Request, e.Response
+
+	// the public scheme of the request is forwarded by the server
+	scheme := req.Header.Get("X-Forwarded-Proto")
+	if scheme == "" {
+		scheme = "http"
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		u = &url.URL{Path: req.URL}
+	}
+	if u.Host == "" {
+		u.Scheme, u.Host = scheme, req.Host
+	}
+
+	entry := harEntry{
+		StartedDateTime: e.Start.Format(time.RFC3339Nano),
+		Time:            millis(e.Duration),
+		Request: harRequest{
+			Method:      req.Method,
+			URL:         u.String(),
+			HTTPVersion: req.Proto,
+			Cookies:     harCookies((&http.Request{Header: req.Header}).Cookies()),
+			Headers:     harNameValues(req.Header),
+			QueryString: harNameValues(u.Query()),
+			HeadersSize: -1,
+			BodySize:    req.BodySize,
+			Comment:     harTruncated(req.CapturedBody),
+		},
+		Response: harResponse{
+			Status:      resp.Status,
+			StatusText:  http.StatusText(resp.Status),
+			HTTPVersion: req.Proto,
+			Cookies:     harCookies((&http.Response{Header: resp.Header}).Cookies()),
+			Headers:     harNameValues(resp.Header),
+			Content:     harContent{Size: resp.BodySize, MimeType: resp.Header.Get("Content-Type")},
+			RedirectURL: resp.Header.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    resp.BodySize,
+			Comment:     harTruncated(resp.CapturedBody),
+		},
+		Timings: harTimings{
+			Blocked: millis(e.Timings.Blocked),
+			DNS:     -1,
+			Connect: -1,
+			Send:    millis(e.Timings.Send),
+			Wait:    millis(e.Timings.Wait),
+			Receive: millis(e.Timings.Receive),
+			SSL:     -1,
+		},
+		Tunnel: millis(e.Timings.Tunnel()),
+		Target: millis(e.Timings.Target()),
+	}
+	if e.Timings.Connect > 0 {
+		entry.Timings.Connect = millis(e.Timings.Connect)
+	}
+	if e.ReplayOf != 0 {
+		entry.Comment = fmt.Sprintf("replay of #%d", e.ReplayOf)
+	}
+	if req.BodySize > 0 {
+		text, encoding := harText(req.Body)
+		entry.Request.PostData = &harPostData{MimeType: req.Header.Get("Content-Type"), Text: text, Encoding: encoding}
+	}
+	entry.Response.Content.Text, entry.Response.Content.Encoding = harText(resp.Body)
+	return entry
+}
+
+// harNameValues returns the headers or the query in the order of the names
+func harNameValues(m map[string][]string) []harNameValue {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	list := []harNameValue{}
+	for _, key := range keys {
+		for _, v := range m[key] {
+			list = append(list, harNameValue{key, v})
+		}
+	}
+	return list
+}
+
+func harCookies(cookies []*http.Cookie) []harCookie {
+	list := []harCookie{}
+	for _, c := range cookies {
+		hc := harCookie{Name: c.Name, Value: c.Value, Path: c.Path, Domain: c.Domain, HTTPOnly: c.HttpOnly, Secure: c.Secure}
+		if !c.Expires.IsZero() {
+			hc.Expires = c.Expires.Format(time.RFC3339)
+		}
+		list = append(list, hc)
+	}
+	return list
+}
+
+// harText returns the body as text, or in base64 if it is binary
+func harText(body []byte) (string, string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+func harTruncated(b CapturedBody) string {
+	if !b.Truncated {
+		return ""
+	}
+	return fmt.Sprintf("body truncated to %d of %d bytes", len(b.Body), b.BodySize)
+}
@@ -0,0 +1,151 @@
+package hypro
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWriteHAR(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	e := &Exchange{
+		ID:       2,
+		Start:    start,
+		Duration: 10 * time.Millisecond,
+		Request: &CapturedRequest{
+			Method: "POST",
+			URL:    "/hook?b=2&a=1",
+			Host:   "app.example.com",
+			Proto:  "HTTP/2.0",
+			Header: http.Header{
+				"X-Forwarded-Proto": {"https"},
+				"Content-Type":      {"application/json"},
+				"Cookie":            {"session=abc"},
+			},
+			CapturedBody: CapturedBody{Body: []byte(`{"a":`), BodySize: 10, Truncated: true},
+		},
+		Response: &CapturedResponse{
+			Status:       http.StatusCreated,
+			Header:       http.Header{"Content-Type": {"image/png"}},
+			CapturedBody: CapturedBody{Body: []byte{0x89, 'P', 'N', 'G', 0xff}, BodySize: 5},
+		},
+		Timings:  Timings{Forward: 3 * time.Millisecond, Blocked: time.Millisecond, Send: time.Millisecond, Wait: 6 * time.Millisecond, Receive: 2 * time.Millisecond},
+		ReplayOf: 1,
+	}
+
+	var buf bytes.Buffer
+	if err := WriteHAR(&buf, []*Exchange{e}); err != nil {
+		t.Fatal(err)
+	}
+	var har harFile
+	if err := json.Unmarshal(buf.Bytes(), &har); err != nil {
+		t.Fatalf("WriteHAR() invalid json: %v", err)
+	}
+	if har.Log.Version != "1.2" || len(har.Log.Entries) != 1 {
+		t.Fatalf("WriteHAR() log = %+v", har.Log)
+	}
+	entry := har.Log.Entries[0]
+
+	if entry.StartedDateTime != "2024-05-01T12:00:00Z" || entry.Time != 10 || entry.Comment != "replay of #1" {
+		t.Errorf("entry = %+v", entry)
+	}
+	if entry.Request.URL != "https://app.example.com/hook?b=2&a=1" {
+		t.Errorf("Request.URL = %s", entry.Request.URL)
+	}
+	wantQuery := []harNameValue{{"a", "1"}, {"b", "2"}}
+	if !reflect.DeepEqual(entry.Request.QueryString, wantQuery) {
+		t.Errorf("Request.QueryString = %v, want %v", entry.Request.QueryString, wantQuery)
+	}
+	if len(entry.Request.Headers) != 3 || entry.Request.Headers[0].Name != "Content-Type" {
+		t.Errorf("Request.Headers = %v", entry.Request.Headers)
+	}
+	if want := []harCookie{{Name: "session", Value: "abc"}}; !reflect.DeepEqual(entry.Request.Cookies, want) {
+		t.Errorf("Request.Cookies = %v, want %v", entry.Request.Cookies, want)
+	}
+	wantPost := &harPostData{MimeType: "application/json", Text: `{"a":`}
+	if !reflect.DeepEqual(entry.Request.PostData, wantPost) || entry.Request.BodySize != 10 || entry.Request.Comment != "body truncated to 5 of 10 bytes" {
+		t.Errorf("Request = %+v", entry.Request)
+	}
+	wantContent := harContent{Size: 5, MimeType: "image/png", Text: "iVBOR/8=", Encoding: "base64"}
+	if entry.Response.Status != 201 || entry.Response.StatusText != "Created" || entry.Response.Content != wantContent {
+		t.Errorf("Response = %+v", entry.Response)
+	}
+	wantTimings := harTimings{Blocked: 1, DNS: -1, Connect: -1, Send: 1, Wait: 6, Receive: 2, SSL: -1}
+	if entry.Timings != wantTimings || entry.Tunnel != 5 || entry.Target != 7 {
+		t.Errorf("Timings = %+v, _tunnel %v, _target %v", entry.Timings, entry.Tunnel, entry.Target)
+	}
+}
+
+func Test_traceTimes_timings(t *testing.T) {
+	start := time.Now()
+	at := func(ms int) time.Time {
+		return start.Add(time.Duration(ms) * time.Millisecond)
+	}
+	tests := []struct {
+		name  string
+		trace *traceTimes
+		want  Timings
+	}{
+		{
+			"NewConn",
+			&traceTimes{connectStart: at(1), gotConn: at(3), wroteRequest: at(4)},
+			Timings{Blocked: at(1).Sub(start), Connect: 2 * time.Millisecond, Send: time.Millisecond, Wait: 4 * time.Millisecond, Receive: 2 * time.Millisecond},
+		},
+		{
+			"ReusedConn",
+			&traceTimes{gotConn: at(1), wroteRequest: at(4)},
+			Timings{Blocked: time.Millisecond, Send: 3 * time.Millisecond, Wait: 4 * time.Millisecond, Receive: 2 * time.Millisecond},
+		},
+		{
+			"NotProxied",
+			&traceTimes{},
+			Timings{Wait: 8 * time.Millisecond, Receive: 2 * time.Millisecond},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.trace.timings(start, at(8), at(10)); got != tt.want {
+				t.Errorf("timings() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHARWriter(t *testing.T) {
+	tests := []struct {
+		name string
+		n    int
+	}{
+		{"Empty", 0},
+		{"More than capacity", 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			hw, err := NewHARWriter(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			i := &Inspector{Capacity: 2, OnRecord: func(e *Exchange) { hw.Write(e) }}
+			h := i.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			for n := 0; n < tt.n; n++ {
+				h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://app.example.com/", nil))
+			}
+			if err := hw.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+
+			var har harFile
+			if err := json.Unmarshal(buf.Bytes(), &har); err != nil {
+				t.Fatalf("HARWriter invalid json: %v\n%s", err, buf.Bytes())
+			}
+			if har.Log.Version != "1.2" || len(har.Log.Entries) != tt.n {
+				t.Errorf("log = %+v, want %d entries", har.Log, tt.n)
+			}
+		})
+	}
+}
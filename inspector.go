@@ -0,0 +1,621 @@
+package hypro
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultInspectorCapacity is the number of the exchanges kept
+	DefaultInspectorCapacity = 100
+	// DefaultInspectorMaxBodySize is the size of the bodies captured
+	DefaultInspectorMaxBodySize = 128 << 10
+)
+
+//go:embed inspector.html
+var inspectorHTML []byte
+
+// receivedHeader is stamped by the server on the forwarded requests with the
+// time it received them in unix nanoseconds, to measure the tunnel leg
+const receivedHeader = "X-Hypro-Received"
+
+var (
+	errExchangeNotFound = errors.New("request not found")
+	errBodyTruncated    = errors.New("request body is truncated, replay it with a new body")
+)
+
+// Inspector records the requests served by the client in a ring buffer, and
+// serves them on a local dashboard with live updates
+type Inspector struct {
+	// Capacity is the number of the exchanges kept, the oldest ones are
+	// dropped, DefaultInspectorCapacity if zero
+	Capacity int
+
+	// MaxBodySize is the size of the request and response bodies captured,
+	// DefaultInspectorMaxBodySize if zero
+	MaxBodySize int
+
+	// OnRecord is called with every recorded exchange if set, e.g. to keep
+	// the exchanges dropped from the ring buffer
+	OnRecord func(e *Exchange)
+
+	mu        sync.Mutex
+	exchanges []*Exchange
+	// next is the index of exchanges the next exchange goes to
+	next        int
+	lastID      int64
+	subscribers map[chan *Exchange]struct{}
+	mux         *http.ServeMux
+}
+
+// Exchange is a request and its response recorded by the Inspector
+type Exchange struct {
+	ID       int64             `json:"id"`
+	Start    time.Time         `json:"start"`
+	Duration time.Duration     `json:"duration"`
+	Request  *CapturedRequest  `json:"request"`
+	Response *CapturedResponse `json:"response"`
+	Timings  Timings           `json:"timings"`
+	// ReplayOf is the id of the exchange replayed, if it is a replay
+	ReplayOf int64 `json:"replay_of,omitempty"`
+
+	// handler is the handler of the tunnel served the request
+	handler http.Handler
+}
+
+// Timings is the phases of the Duration of an exchange, the ones of the
+// target connection are zero if the request is not proxied, e.g. the static
+// files, or the connection is reused
+type Timings struct {
+	// Forward is the time from the server receiving the request to the
+	// client receiving it, before the Duration, zero if the server did not
+	// stamp it. It is measured with the clocks of both sides
+	Forward time.Duration `json:"forward"`
+	// Blocked is the time before the connection to the target
+	Blocked time.Duration `json:"blocked"`
+	// Connect is the time to connect to the target
+	Connect time.Duration `json:"connect"`
+	// Send is the time to send the request to the target
+	Send time.Duration `json:"send"`
+	// Wait is the time waiting for the response of the target
+	Wait time.Duration `json:"wait"`
+	// Receive is the time to stream the response to the tunnel
+	Receive time.Duration `json:"receive"`
+}
+
+// Target returns the time spent on the local target
+func (t Timings) Target() time.Duration {
+	return t.Connect + t.Send + t.Wait
+}
+
+// Tunnel returns the time spent on the transfer through the tunnel, from the
+// server to the client and back
+func (t Timings) Tunnel() time.Duration {
+	return t.Forward + t.Receive
+}
+
+// Replay is the edits of the replayed request, the zero values keep the
+// recorded ones
+type Replay struct {
+	Method string `json:"method,omitempty"`
+	URL    string `json:"url,omitempty"`
+	// Header replaces all the headers of the request, if not nil
+	Header http.Header `json:"header,omitempty"`
+	// Body replaces the body of the request, if not nil
+	Body *[]byte `json:"body,omitempty"`
+}
+
+// CapturedRequest is a recorded request
+type CapturedRequest struct {
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	Host       string      `json:"host"`
+	Proto      string      `json:"proto"`
+	RemoteAddr string      `json:"remote_addr"`
+	Header     http.Header `json:"header"`
+	CapturedBody
+}
+
+// CapturedResponse is a recorded response
+type CapturedResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	CapturedBody
+}
+
+// CapturedBody is the body capped at the MaxBodySize of the Inspector
+type CapturedBody struct {
+	Body []byte `json:"body"`
+	// BodySize is the size of the whole body
+	BodySize int64 `json:"body_size"`
+	// Truncated is whether the body is larger than the captured one
+	Truncated bool `json:"truncated"`
+}
+
+// Handler returns the handler recording the requests served by h
+func (i *Inspector) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i.record(h, w, r, 0)
+	})
+}
+
+// record serves the request with h, and returns the exchange recorded
+func (i *Inspector) record(h http.Handler, w http.ResponseWriter, r *http.Request, replayOf int64) *Exchange {
+	received := receivedAt(r)
+	e := &Exchange{
+		Start: time.Now(),
+		Request: &CapturedRequest{
+			Method:     r.Method,
+			URL:        r.URL.String(),
+			Host:       r.Host,
+			Proto:      r.Proto,
+			RemoteAddr: r.RemoteAddr,
+			Header:     r.Header.Clone(),
+		},
+		ReplayOf: replayOf,
+		handler:  h,
+	}
+	reqBody := &captureBody{max: i.maxBodySize()}
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &captureReader{ReadCloser: r.Body, body: reqBody}
+	}
+	rw := &captureResponseWriter{ResponseWriter: w, body: &captureBody{max: i.maxBodySize()}}
+	tt := &traceTimes{}
+	r = r.WithContext(httptrace.WithClientTrace(r.Context(), tt.clientTrace()))
+
+	defer func() {
+		e.Duration = time.Since(e.Start)
+		e.Timings = tt.timings(e.Start, rw.headerTime, e.Start.Add(e.Duration))
+		if !received.IsZero() && received.Before(e.Start) {
+			e.Timings.Forward = e.Start.Sub(received)
+		}
+		e.Request.CapturedBody = reqBody.captured()
+		if rw.status == 0 {
+			// the handler wrote nothing
+			rw.status = http.StatusOK
+		}
+		e.Response = &CapturedResponse{
+			Status:       rw.status,
+			Header:       rw.header,
+			CapturedBody: rw.body.captured(),
+		}
+		if e.Response.Header == nil {
+			e.Response.Header = w.Header().Clone()
+		}
+		i.add(e)
+		if i.OnRecord != nil {
+			i.OnRecord(e)
+		}
+	}()
+	h.ServeHTTP(rw, r)
+	return e
+}
+
+// Replay sends the recorded request of the id again to the target of its
+// tunnel with the edits, and returns the exchange of the replay
+func (i *Inspector) Replay(ctx context.Context, id int64, edit *Replay) (*Exchange, error) {
+	e := i.Exchange(id)
+	if e == nil || e.handler == nil {
+		return nil, errExchangeNotFound
+	}
+	if edit == nil {
+		edit = &Replay{}
+	}
+
+	method, target, header, body := e.Request.Method, e.Request.URL, e.Request.Header.Clone(), e.Request.Body
+	if edit.Method != "" {
+		method = edit.Method
+	}
+	if edit.URL != "" {
+		target = edit.URL
+	}
+	if edit.Header != nil {
+		header = edit.Header.Clone()
+	}
+	if edit.Body != nil {
+		body = *edit.Body
+	} else if e.Request.Truncated {
+		return nil, errBodyTruncated
+	}
+
+	r, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid replay request")
+	}
+	if len(body) == 0 {
+		r.Body = http.NoBody
+	}
+	header.Del("Content-Length")
+	r.Header = header
+	r.Host = e.Request.Host
+	r.Proto = e.Request.Proto
+	r.RemoteAddr = e.Request.RemoteAddr
+	return i.record(e.handler, &replayResponseWriter{header: make(http.Header)}, r, e.ID), nil
+}
+
+func (i *Inspector) maxBodySize() int {
+	if i.MaxBodySize > 0 {
+		return i.MaxBodySize
+	}
+	return DefaultInspectorMaxBodySize
+}
+
+// add records the exchange, and sends it to the subscribers
+func (i *Inspector) add(e *Exchange) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.exchanges == nil {
+		capacity := i.Capacity
+		if capacity <= 0 {
+			capacity = DefaultInspectorCapacity
+		}
+		i.exchanges = make([]*Exchange, capacity)
+	}
+	i.lastID++
+	e.ID = i.lastID
+	i.exchanges[i.next] = e
+	i.next = (i.next + 1) % len(i.exchanges)
+	for ch := range i.subscribers {
+		select {
+		case ch <- e:
+		default:
+			// the slow subscriber misses it, and reloads the list
+		}
+	}
+}
+
+// Exchanges returns the recorded exchanges, the newest first
+func (i *Inspector) Exchanges() []*Exchange {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	var list []*Exchange
+	for n := 1; n <= len(i.exchanges); n++ {
+		e := i.exchanges[(i.next-n+len(i.exchanges))%len(i.exchanges)]
+		if e == nil {
+			break
+		}
+		list = append(list, e)
+	}
+	return list
+}
+
+// Exchange returns the recorded exchange of the id, or nil if it is dropped
+func (i *Inspector) Exchange(id int64) *Exchange {
+	for _, e := range i.Exchanges() {
+		if e.ID == id {
+			return e
+		}
+	}
+	return nil
+}
+
+// subscribe returns the channel of the new exchanges, until unsubscribed
+func (i *Inspector) subscribe() chan *Exchange {
+	ch := make(chan *Exchange, 16)
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.subscribers == nil {
+		i.subscribers = make(map[chan *Exchange]struct{})
+	}
+	i.subscribers[ch] = struct{}{}
+	return ch
+}
+
+func (i *Inspector) unsubscribe(ch chan *Exchange) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	delete(i.subscribers, ch)
+}
+
+// ServeHTTP serves the dashboard and its api
+func (i *Inspector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// the captured headers and bodies are not served to the other hosts, so
+	// that a web page could not read them by DNS rebinding
+	if !isInspectorHost(r) {
+		http.Error(w, "invalid host "+r.Host, http.StatusForbidden)
+		return
+	}
+	i.mu.Lock()
+	if i.mux == nil {
+		i.mux = http.NewServeMux()
+		i.mux.HandleFunc("GET /{$}", i.serveDashboard)
+		i.mux.HandleFunc("GET /api/requests", i.serveExchanges)
+		i.mux.HandleFunc("GET /api/requests/{id}", i.serveExchange)
+		i.mux.HandleFunc("POST /api/requests/{id}/replay", i.serveReplay)
+		i.mux.HandleFunc("GET /api/events", i.serveEvents)
+		i.mux.HandleFunc("GET /api/har", i.serveHAR)
+	}
+	mux := i.mux
+	i.mu.Unlock()
+	mux.ServeHTTP(w, r)
+}
+
+// isInspectorHost reports whether the host of the request is a loopback name
+// or address, or the address the inspector is listening on
+func isInspectorHost(r *http.Request) bool {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	local, ok := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr)
+	return ok && local.IP.Equal(ip)
+}
+
+func (i *Inspector) serveDashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(inspectorHTML)
+}
+
+func (i *Inspector) serveExchanges(w http.ResponseWriter, r *http.Request) {
+	list := i.Exchanges()
+	if list == nil {
+		list = []*Exchange{}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (i *Inspector) serveExchange(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	e := i.Exchange(id)
+	if e == nil {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, e)
+}
+
+func (i *Inspector) serveReplay(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	// a web page could only send a cross-origin form or text/plain post
+	// without a preflight, which is rejected
+	if origin := r.Header.Get("Origin"); origin != "" && origin != "http://"+r.Host {
+		http.Error(w, "invalid origin "+origin, http.StatusForbidden)
+		return
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		http.Error(w, "replay should be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	edit := &Replay{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(edit); err != nil {
+			http.Error(w, "invalid replay: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	e, err := i.Replay(r.Context(), id, edit)
+	switch {
+	case err == errExchangeNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	default:
+		writeJSON(w, http.StatusOK, e)
+	}
+}
+
+func (i *Inspector) serveHAR(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="hypro.har"`)
+	i.WriteHAR(w)
+}
+
+// serveEvents streams the new exchanges with server-sent events
+func (i *Inspector) serveEvents(w http.ResponseWriter, r *http.Request) {
+	ch := i.subscribe()
+	defer i.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	rc := http.NewResponseController(w)
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+	for {
+		select {
+		case e := <-ch:
+			b, err := json.Marshal(e)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", b); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// captureBody keeps the first max bytes of a body, and counts all of them
+type captureBody struct {
+	mu   sync.Mutex
+	max  int
+	buf  []byte
+	size int64
+}
+
+func (b *captureBody) write(p []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.size += int64(len(p))
+	if n := b.max - len(b.buf); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		b.buf = append(b.buf, p[:n]...)
+	}
+}
+
+func (b *captureBody) captured() CapturedBody {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return CapturedBody{Body: b.buf, BodySize: b.size, Truncated: b.size > int64(len(b.buf))}
+}
+
+// captureReader captures the request body read by the handler
+type captureReader struct {
+	io.ReadCloser
+	body *captureBody
+}
+
+func (r *captureReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.body.write(p[:n])
+	return n, err
+}
+
+// captureResponseWriter captures the response written by the handler, the
+// Flush and Hijack of http.ResponseController go to the underlying writer
+type captureResponseWriter struct {
+	http.ResponseWriter
+	status     int
+	header     http.Header
+	headerTime time.Time
+	body       *captureBody
+}
+
+func (w *captureResponseWriter) WriteHeader(code int) {
+	// the informational responses are followed by the final one, except
+	// switching protocols
+	if w.status == 0 && (code >= 200 || code == http.StatusSwitchingProtocols) {
+		w.status = code
+		w.header = w.ResponseWriter.Header().Clone()
+		w.headerTime = time.Now()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *captureResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.body.write(b[:n])
+	return n, err
+}
+
+func (w *captureResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// receivedAt removes the receivedHeader stamped by the server from r, and
+// returns its time, zero if there is none
+func receivedAt(r *http.Request) time.Time {
+	v := r.Header.Get(receivedHeader)
+	if v == "" {
+		return time.Time{}
+	}
+	r.Header.Del(receivedHeader)
+	ns, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// traceTimes records the times of the connection to the target, the
+// callbacks could be called by the goroutines of the transport
+type traceTimes struct {
+	mu                    sync.Mutex
+	connectStart, gotConn time.Time
+	wroteRequest          time.Time
+}
+
+func (t *traceTimes) clientTrace() *httptrace.ClientTrace {
+	set := func(p *time.Time) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if p.IsZero() {
+			*p = time.Now()
+		}
+	}
+	return &httptrace.ClientTrace{
+		ConnectStart: func(network, addr string) { set(&t.connectStart) },
+		GotConn:      func(httptrace.GotConnInfo) { set(&t.gotConn) },
+		WroteRequest: func(httptrace.WroteRequestInfo) { set(&t.wroteRequest) },
+	}
+}
+
+// timings splits the time from start to end by the times of the target
+// connection and the response header
+func (t *traceTimes) timings(start, header, end time.Time) Timings {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if header.IsZero() {
+		header = end
+	}
+	var tm Timings
+	sent := start
+	if !t.gotConn.IsZero() && !t.wroteRequest.IsZero() {
+		blockedEnd := t.gotConn
+		if !t.connectStart.IsZero() {
+			// including the tls handshake of https targets
+			blockedEnd = t.connectStart
+			tm.Connect = t.gotConn.Sub(t.connectStart)
+		}
+		tm.Blocked = blockedEnd.Sub(start)
+		tm.Send = t.wroteRequest.Sub(t.gotConn)
+		sent = t.wroteRequest
+	}
+	tm.Wait = header.Sub(sent)
+	tm.Receive = end.Sub(header)
+	return tm
+}
+
+// replayResponseWriter discards the response of a replay, which is recorded
+// by the captureResponseWriter
+type replayResponseWriter struct {
+	header http.Header
+}
+
+func (w *replayResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *replayResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w *replayResponseWriter) WriteHeader(code int) {}
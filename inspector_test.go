@@ -0,0 +1,312 @@
+package hypro
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInspector_Handler(t *testing.T) {
+	i := &Inspector{MaxBodySize: 4}
+	h := i.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		w.Header().Set("X-Test", "yes")
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, "created")
+	}))
+
+	tests := []struct {
+		name       string
+		body       string
+		wantReq    CapturedBody
+		wantStatus int
+	}{
+		{"Small", "abc", CapturedBody{Body: []byte("abc"), BodySize: 3}, http.StatusCreated},
+		{"Truncated", "abcdef", CapturedBody{Body: []byte("abcd"), BodySize: 6, Truncated: true}, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "http://app.example.com/path?q=1", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", "text/plain")
+			h.ServeHTTP(httptest.NewRecorder(), r)
+
+			e := i.Exchanges()[0]
+			if e.Request.Method != "POST" || e.Request.URL != "http://app.example.com/path?q=1" || e.Request.Host != "app.example.com" {
+				t.Errorf("Request = %+v", e.Request)
+			}
+			if got := e.Request.Header.Get("Content-Type"); got != "text/plain" {
+				t.Errorf("Request.Header Content-Type = %s", got)
+			}
+			if got := e.Request.CapturedBody; string(got.Body) != string(tt.wantReq.Body) || got.BodySize != tt.wantReq.BodySize || got.Truncated != tt.wantReq.Truncated {
+				t.Errorf("Request.CapturedBody = %+v, want %+v", got, tt.wantReq)
+			}
+			if e.Response.Status != tt.wantStatus || e.Response.Header.Get("X-Test") != "yes" {
+				t.Errorf("Response = %+v", e.Response)
+			}
+			if got := e.Response.CapturedBody; string(got.Body) != "crea" || got.BodySize != 7 || !got.Truncated {
+				t.Errorf("Response.CapturedBody = %+v", got)
+			}
+		})
+	}
+}
+
+func TestInspector_Handler_received(t *testing.T) {
+	i := &Inspector{}
+	var forwarded string
+	h := i.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Get(receivedHeader)
+	}))
+
+	tests := []struct {
+		name        string
+		received    string
+		wantForward bool
+	}{
+		{"Stamped", strconv.FormatInt(time.Now().Add(-time.Second).UnixNano(), 10), true},
+		{"Not stamped", "", false},
+		{"Invalid", "yesterday", false},
+		{"Clock skew", strconv.FormatInt(time.Now().Add(time.Hour).UnixNano(), 10), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://app.example.com/", nil)
+			if tt.received != "" {
+				r.Header.Set(receivedHeader, tt.received)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), r)
+
+			e := i.Exchanges()[0]
+			if got := e.Timings.Forward; (got >= time.Second) != tt.wantForward || (!tt.wantForward && got != 0) {
+				t.Errorf("Timings.Forward = %v, want forward %v", got, tt.wantForward)
+			}
+			if forwarded != "" || e.Request.Header.Get(receivedHeader) != "" {
+				t.Errorf("%s is forwarded to the target", receivedHeader)
+			}
+		})
+	}
+}
+
+func TestInspector_Exchanges(t *testing.T) {
+	i := &Inspector{Capacity: 3}
+	for n := 0; n < 5; n++ {
+		i.add(&Exchange{})
+	}
+	var ids []int64
+	for _, e := range i.Exchanges() {
+		ids = append(ids, e.ID)
+	}
+	if len(ids) != 3 || ids[0] != 5 || ids[1] != 4 || ids[2] != 3 {
+		t.Errorf("Exchanges() ids = %v, want [5 4 3]", ids)
+	}
+	if i.Exchange(2) != nil {
+		t.Error("Exchange(2) is not dropped")
+	}
+	if e := i.Exchange(4); e == nil || e.ID != 4 {
+		t.Errorf("Exchange(4) = %v", e)
+	}
+}
+
+func TestInspector_ServeHTTP(t *testing.T) {
+	i := &Inspector{}
+	i.Handler(http.NotFoundHandler()).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/missing", nil))
+
+	tests := []struct {
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{"/", http.StatusOK, "<title>hypro inspector</title>"},
+		{"/api/requests", http.StatusOK, `"url":"/missing"`},
+		{"/api/requests/1", http.StatusOK, `"status":404`},
+		{"/api/requests/2", http.StatusNotFound, ""},
+		{"/api/requests/abc", http.StatusBadRequest, ""},
+		{"/api/har", http.StatusOK, `"url": "http://example.com/missing"`},
+		{"/other", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			i.ServeHTTP(w, newInspectorRequest("GET", tt.path, nil))
+			if w.Code != tt.wantStatus || !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("GET %s = %d %s, want %d %s", tt.path, w.Code, w.Body, tt.wantStatus, tt.wantBody)
+			}
+		})
+	}
+}
+
+// newInspectorRequest returns a request to the inspector on localhost
+func newInspectorRequest(method, target string, body io.Reader) *http.Request {
+	r := httptest.NewRequest(method, target, body)
+	r.Host = "localhost:4040"
+	return r
+}
+
+func Test_isInspectorHost(t *testing.T) {
+	tests := []struct {
+		host  string
+		local string
+		want  bool
+	}{
+		{"localhost:4040", "", true},
+		{"LOCALHOST.", "", true},
+		{"app.localhost:4040", "", true},
+		{"127.0.0.1:4040", "", true},
+		{"127.0.0.2", "", true},
+		{"[::1]:4040", "", true},
+		{"192.168.1.2:4040", "192.168.1.2", true},
+		{"192.168.1.3:4040", "192.168.1.2", false},
+		{"attacker.example.com:4040", "", false},
+		{"localhost.example.com", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Host = tt.host
+			if tt.local != "" {
+				local := &net.TCPAddr{IP: net.ParseIP(tt.local), Port: 4040}
+				r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, local))
+			}
+			if got := isInspectorHost(r); got != tt.want {
+				t.Errorf("isInspectorHost(%s) = %v, want %v", tt.host, got, tt.want)
+			}
+		})
+	}
+
+	t.Run("Forbidden", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/api/requests", nil)
+		r.Host = "attacker.example.com:4040"
+		(&Inspector{}).ServeHTTP(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("GET /api/requests of another host = %d, want 403", w.Code)
+		}
+	})
+}
+
+func TestInspector_events(t *testing.T) {
+	i := &Inspector{}
+	srv := httptest.NewServer(i)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/api/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Fatalf("Content-Type = %s", got)
+	}
+
+	// the response header is flushed after subscribing
+	i.Handler(http.NotFoundHandler()).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/live", nil))
+
+	lines := make(chan string)
+	go func() {
+		s := bufio.NewScanner(resp.Body)
+		for s.Scan() {
+			lines <- s.Text()
+		}
+	}()
+	select {
+	case line := <-lines:
+		var e Exchange
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e); err != nil {
+			t.Fatalf("event %s: %v", line, err)
+		}
+		if e.ID != 1 || e.Request.URL != "/live" {
+			t.Errorf("event = %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+	}
+}
+
+func TestInspector_Replay(t *testing.T) {
+	i := &Inspector{MaxBodySize: 64}
+	h := i.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %s %s %s", r.Method, r.Host, r.URL, r.Header.Get("X-Test"), b)
+	}))
+	for _, body := range []string{"hello", strings.Repeat("x", 100)} {
+		r := httptest.NewRequest("POST", "/hook", strings.NewReader(body))
+		r.Header.Set("X-Test", "a")
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	newBody := []byte("edited")
+
+	tests := []struct {
+		name    string
+		id      int64
+		edit    *Replay
+		want    string
+		wantErr error
+	}{
+		{"Same", 1, nil, "POST example.com /hook a hello", nil},
+		{"Edited", 1, &Replay{Method: "PUT", URL: "/hook?n=1", Header: http.Header{"X-Test": {"b"}}, Body: &newBody}, "PUT example.com /hook?n=1 b edited", nil},
+		{"Truncated", 2, nil, "", errBodyTruncated},
+		{"TruncatedEdited", 2, &Replay{Body: &newBody}, "POST example.com /hook a edited", nil},
+		{"NotFound", 9, nil, "", errExchangeNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := i.Replay(context.Background(), tt.id, tt.edit)
+			if err != tt.wantErr {
+				t.Fatalf("Replay() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := string(e.Response.Body); got != tt.want {
+				t.Errorf("Replay() response = %s, want %s", got, tt.want)
+			}
+			if e.ReplayOf != tt.id || i.Exchanges()[0] != e {
+				t.Errorf("Replay() = %+v, not recorded as the replay of %d", e, tt.id)
+			}
+		})
+	}
+
+	t.Run("API", func(t *testing.T) {
+		apiTests := []struct {
+			name        string
+			path        string
+			contentType string
+			origin      string
+			body        string
+			wantStatus  int
+			wantBody    string
+		}{
+			{"Edited", "/api/requests/1/replay", "application/json", "", `{"method":"PATCH"}`, http.StatusOK, `"method":"PATCH"`},
+			{"SameOrigin", "/api/requests/1/replay", "application/json; charset=utf-8", "http://localhost:4040", `{}`, http.StatusOK, `"replay_of":1`},
+			{"Truncated", "/api/requests/2/replay", "application/json", "", "", http.StatusUnprocessableEntity, ""},
+			{"TextPlain", "/api/requests/1/replay", "text/plain", "", `{"method":"PATCH"}`, http.StatusUnsupportedMediaType, ""},
+			{"NoContentType", "/api/requests/1/replay", "", "", "", http.StatusUnsupportedMediaType, ""},
+			{"CrossOrigin", "/api/requests/1/replay", "application/json", "http://attacker.example.com", `{}`, http.StatusForbidden, ""},
+		}
+		for _, tt := range apiTests {
+			t.Run(tt.name, func(t *testing.T) {
+				r := newInspectorRequest("POST", tt.path, strings.NewReader(tt.body))
+				if tt.contentType != "" {
+					r.Header.Set("Content-Type", tt.contentType)
+				}
+				if tt.origin != "" {
+					r.Header.Set("Origin", tt.origin)
+				}
+				w := httptest.NewRecorder()
+				i.ServeHTTP(w, r)
+				if w.Code != tt.wantStatus || !strings.Contains(w.Body.String(), tt.wantBody) {
+					t.Errorf("POST %s = %d %s, want %d %s", tt.path, w.Code, w.Body, tt.wantStatus, tt.wantBody)
+				}
+			})
+		}
+	})
+}
@@ -0,0 +1,80 @@
+package hypro
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// makeMutualTLSCreds returns the server credentials requiring the client
+// certificates signed by the ca
+func makeMutualTLSCreds(certFile, keyFile, clientCAFile string) (credentials.TransportCredentials, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "certificates invalid")
+	}
+	pool, err := loadCertPool(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	return credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}), nil
+}
+
+// loadCertPool reads the pem encoded certificates
+func loadCertPool(filename string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read certificates")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, errors.Errorf("no certificates found in %s", filename)
+	}
+	return pool, nil
+}
+
+// clientCertDomains returns the domain patterns of the verified client
+// certificate, from its DNS SANs or the common name
+func clientCertDomains(ctx context.Context) ([]string, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, false
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return nil, false
+	}
+	cert := info.State.VerifiedChains[0][0]
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames, true
+	}
+	return []string{cert.Subject.CommonName}, true
+}
+
+// checkClientCert checks the domain is allowed by the client certificate
+func (s *Server) checkClientCert(ctx context.Context, domain string) error {
+	if s.ClientCAFile == "" {
+		return nil
+	}
+	patterns, ok := clientCertDomains(ctx)
+	if !ok {
+		return status.Errorf(codes.Unauthenticated, "client certificate required")
+	}
+	for _, pattern := range patterns {
+		if matchDomain(pattern, domain) {
+			return nil
+		}
+	}
+	return status.Errorf(codes.PermissionDenied, "domain %s is not allowed by the client certificate", domain)
+}
@@ -0,0 +1,197 @@
+package hypro
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// newTestCA returns a self-signed ca certificate
+func newTestCA(t *testing.T) *tls.Certificate {
+	t.Helper()
+	return newSignedTestCert(t, nil, "hypro test ca")
+}
+
+// newSignedTestCert returns a certificate of the common name and the names,
+// the dns names or the ip addresses, signed by the ca, or a ca if it is nil
+func newSignedTestCert(t *testing.T, ca *tls.Certificate, cn string, names ...string) *tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+	parent, signer := template, interface{}(key)
+	if ca == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, signer = ca.Leaf, ca.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// peerContext returns the context of a grpc call over tls with the state
+func peerContext(state tls.ConnectionState) context.Context {
+	return peer.NewContext(context.Background(), &peer.Peer{AuthInfo: credentials.TLSInfo{State: state}})
+}
+
+func TestServer_checkClientCert(t *testing.T) {
+	ca := newTestCA(t)
+	verified := func(cert *tls.Certificate) context.Context {
+		return peerContext(tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{cert.Leaf},
+			VerifiedChains:   [][]*x509.Certificate{{cert.Leaf, ca.Leaf}},
+		})
+	}
+	sans := newSignedTestCert(t, ca, "ignored.example.com", "app.example.com", "*.team.example.com")
+	cn := newSignedTestCert(t, ca, "cn.example.com")
+
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		domain   string
+		wantCode codes.Code
+	}{
+		{"SAN", verified(sans), "app.example.com", codes.OK},
+		{"SAN wildcard", verified(sans), "dev.team.example.com", codes.OK},
+		{"SAN wildcard one label", verified(sans), "a.dev.team.example.com", codes.PermissionDenied},
+		{"CN ignored with SANs", verified(sans), "ignored.example.com", codes.PermissionDenied},
+		{"CN", verified(cn), "cn.example.com", codes.OK},
+		{"Not covered", verified(cn), "other.example.com", codes.PermissionDenied},
+		{"No peer", context.Background(), "app.example.com", codes.Unauthenticated},
+		{"No cert", peerContext(tls.ConnectionState{}), "app.example.com", codes.Unauthenticated},
+		{"Unverified", peerContext(tls.ConnectionState{PeerCertificates: []*x509.Certificate{sans.Leaf}}), "app.example.com", codes.Unauthenticated},
+	}
+	s := &Server{ClientCAFile: "ca.pem"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := s.checkClientCert(tt.ctx, tt.domain); status.Code(err) != tt.wantCode {
+				t.Errorf("checkClientCert() error = %v, want %v", err, tt.wantCode)
+			}
+		})
+	}
+
+	t.Run("Disabled", func(t *testing.T) {
+		if err := (&Server{}).checkClientCert(context.Background(), "app.example.com"); err != nil {
+			t.Errorf("checkClientCert() without client ca error = %v", err)
+		}
+	})
+}
+
+func Test_makeMutualTLSCreds(t *testing.T) {
+	ca := newTestCA(t)
+	caFile, _ := writeTestCert(t, ca)
+	certFile, keyFile := writeTestCert(t, newSignedTestCert(t, ca, "127.0.0.1", "127.0.0.1"))
+
+	tests := []struct {
+		name                            string
+		certFile, keyFile, clientCAFile string
+		wantErr                         bool
+	}{
+		{"OK", certFile, keyFile, caFile, false},
+		{"Missing ca", certFile, keyFile, caFile + ".missing", true},
+		{"Invalid ca", certFile, keyFile, keyFile, true},
+		{"Invalid cert", keyFile, keyFile, caFile, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := makeMutualTLSCreds(tt.certFile, tt.keyFile, tt.clientCAFile); (err != nil) != tt.wantErr {
+				t.Errorf("makeMutualTLSCreds() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestServer_mutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	caFile, _ := writeTestCert(t, ca)
+	s := &Server{
+		GRPCAddr:     fmt.Sprintf("127.0.0.1:%d", freePort(t)),
+		HTTPAddr:     fmt.Sprintf("127.0.0.1:%d", freePort(t)),
+		ClientCAFile: caFile,
+	}
+	s.CertFile, s.KeyFile = writeTestCert(t, newSignedTestCert(t, ca, "127.0.0.1", "127.0.0.1"))
+	go s.ListenAndServe()
+	defer s.Shutdown(context.Background())
+	waitForListener(t, s.GRPCAddr)
+
+	clientCertFile, clientKeyFile := writeTestCert(t, newSignedTestCert(t, ca, "client", "*.team.localhost"))
+	// signed by another ca
+	otherCertFile, otherKeyFile := writeTestCert(t, newSignedTestCert(t, newTestCA(t), "client", "*.team.localhost"))
+
+	tests := []struct {
+		name              string
+		domain            string
+		certFile, keyFile string
+		wantCode          codes.Code
+	}{
+		{"Allowed", "app.team.localhost", clientCertFile, clientKeyFile, codes.OK},
+		{"Not allowed", "app.localhost", clientCertFile, clientKeyFile, codes.PermissionDenied},
+		// the handshake fails
+		{"No client cert", "app.team.localhost", "", "", codes.Unavailable},
+		{"Unknown ca", "app.team.localhost", otherCertFile, otherKeyFile, codes.Unavailable},
+	}
+	_, port, _ := net.SplitHostPort(s.GRPCAddr)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Client{
+				Server:         "127.0.0.1",
+				Domain:         tt.domain,
+				CertFile:       caFile,
+				ClientCertFile: tt.certFile,
+				ClientKeyFile:  tt.keyFile,
+			}
+			fmt.Sscan(port, &c.ServerPort)
+			err := c.Dial()
+			defer c.Close()
+			if got := status.Code(errors.Cause(err)); got != tt.wantCode {
+				t.Fatalf("Dial() error = %v, want %v", err, tt.wantCode)
+			}
+			if err == nil && !s.Authenticated(tt.domain, c.tunnels()[0].token) {
+				t.Errorf("%s is not registered", tt.domain)
+			}
+		})
+	}
+}
@@ -0,0 +1,479 @@
+package hypro
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	pb "github.com/chuangbo/hypro/protos"
+	"github.com/pkg/errors"
+)
+
+const (
+	// muxMetadataKey is sent by the client to run CreateTunnel in multiplexing mode
+	muxMetadataKey = "hypro-mux"
+
+	// maxPacketSize is the max data size of a single packet
+	maxPacketSize = 32 * 1024
+
+	// muxWindowSize is the initial send window of every logical connection
+	muxWindowSize = 256 * 1024
+)
+
+var errSessionClosed = errors.New("tunnel session closed")
+
+// packetStream is the CreateTunnel stream of either side
+type packetStream interface {
+	Send(*pb.Packet) error
+	Recv() (*pb.Packet, error)
+	Context() context.Context
+}
+
+// muxSession carries many logical connections over one CreateTunnel stream,
+// each packet is framed with the stream id of its connection
+type muxSession struct {
+	stream packetStream
+	sendMu sync.Mutex // stream.Send is not safe to call concurrently
+
+	mu       sync.Mutex // protects conns, nextID, closed and draining
+	conns    map[uint32]*muxConn
+	nextID   uint32
+	closed   bool
+	draining bool // GOAWAY sent, the peer's new connections are refused
+
+	// accepts receives the connections opened by the peer,
+	// the peer is not allowed to open connections if it is nil
+	accepts chan<- net.Conn
+
+	// onDatagram receives the datagrams of a UDP tunnel,
+	// they are dropped if it is nil
+	onDatagram func(addr string, data []byte)
+
+	// goAway is closed when the peer sent GOAWAY
+	goAway     chan struct{}
+	goAwayOnce sync.Once
+
+	done chan struct{}
+
+	logger *slog.Logger
+}
+
+func newMuxSession(stream packetStream, accepts chan<- net.Conn) *muxSession {
+	return &muxSession{
+		stream:  stream,
+		conns:   map[uint32]*muxConn{},
+		accepts: accepts,
+		goAway:  make(chan struct{}),
+		done:    make(chan struct{}),
+		logger:  slog.Default(),
+	}
+}
+
+// serve reads packets from the stream and dispatches them to the connections
+// until the stream ends
+func (s *muxSession) serve() error {
+	defer s.close()
+
+	for {
+		packet, err := s.stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "could not recv from stream")
+		}
+
+		switch packet.Type {
+		case pb.Packet_OPEN:
+			s.accept(packet.StreamId)
+		case pb.Packet_DATA:
+			if c := s.conn(packet.StreamId); c != nil {
+				c.push(packet.Data)
+			}
+		case pb.Packet_WINDOW:
+			if c := s.conn(packet.StreamId); c != nil {
+				c.grow(packet.Window)
+			}
+		case pb.Packet_CLOSE:
+			if c := s.conn(packet.StreamId); c != nil {
+				s.remove(c.id)
+				c.closeRemote()
+			}
+		case pb.Packet_CLOSE_WRITE:
+			if c := s.conn(packet.StreamId); c != nil {
+				c.closeRemoteWrite()
+			}
+		case pb.Packet_GOAWAY:
+			s.goAwayOnce.Do(func() { close(s.goAway) })
+		case pb.Packet_DATAGRAM:
+			if s.onDatagram != nil {
+				s.onDatagram(packet.Addr, packet.Data)
+			}
+		}
+	}
+}
+
+// goingAway reports whether the peer sent GOAWAY
+func (s *muxSession) goingAway() bool {
+	select {
+	case <-s.goAway:
+		return true
+	default:
+		return false
+	}
+}
+
+// sendGoAway tells the peer not to open connections any more, the existing
+// connections keep working
+func (s *muxSession) sendGoAway() error {
+	s.mu.Lock()
+	s.draining = true
+	s.mu.Unlock()
+	return s.send(&pb.Packet{Type: pb.Packet_GOAWAY})
+}
+
+// open creates a new logical connection and tells the peer about it
+func (s *muxSession) open() (net.Conn, error) {
+	if s.goingAway() {
+		return nil, errSessionClosed
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, errSessionClosed
+	}
+	s.nextID++
+	c := newMuxConn(s, s.nextID)
+	s.conns[c.id] = c
+	s.mu.Unlock()
+
+	if err := s.send(&pb.Packet{Type: pb.Packet_OPEN, StreamId: c.id}); err != nil {
+		s.remove(c.id)
+		return nil, err
+	}
+	s.logger.Debug("stream opened", "stream_id", c.id)
+	return c, nil
+}
+
+// sendDatagram sends the datagram of the remote peer addr
+func (s *muxSession) sendDatagram(addr string, data []byte) error {
+	return s.send(&pb.Packet{Type: pb.Packet_DATAGRAM, Addr: addr, Data: data})
+}
+
+func (s *muxSession) accept(id uint32) {
+	s.mu.Lock()
+	if s.accepts == nil || s.closed || s.draining || s.conns[id] != nil {
+		s.mu.Unlock()
+		s.send(&pb.Packet{Type: pb.Packet_CLOSE, StreamId: id})
+		return
+	}
+	c := newMuxConn(s, id)
+	s.conns[id] = c
+	s.mu.Unlock()
+
+	s.logger.Debug("stream accepted", "stream_id", id)
+	select {
+	case s.accepts <- c:
+	case <-s.done:
+	}
+}
+
+func (s *muxSession) conn(id uint32) *muxConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns[id]
+}
+
+func (s *muxSession) remove(id uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, id)
+}
+
+// numConns returns the number of open logical connections
+func (s *muxSession) numConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+func (s *muxSession) send(packet *pb.Packet) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	select {
+	case <-s.done:
+		return errSessionClosed
+	default:
+	}
+	if err := s.stream.Send(packet); err != nil {
+		return errors.Wrap(err, "could not send to stream")
+	}
+	return nil
+}
+
+// close ends all the logical connections
+func (s *muxSession) close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	conns := s.conns
+	s.conns = map[uint32]*muxConn{}
+	close(s.done)
+	s.mu.Unlock()
+
+	for _, c := range conns {
+		c.closeRemote()
+	}
+}
+
+// muxConn is a logical connection of a muxSession
+type muxConn struct {
+	id      uint32
+	session *muxSession
+
+	mu           sync.Mutex // protects the fields below
+	buf          []byte
+	consumed     uint32 // bytes read but not yet returned to the peer's window
+	sendWindow   uint32
+	closed       bool
+	remoteClosed bool
+	// writeClosed is set by CloseWrite, and remoteWriteClosed when the
+	// peer closed its write side
+	writeClosed       bool
+	remoteWriteClosed bool
+	readDeadline      time.Time
+	writeDeadline     time.Time
+
+	readable chan struct{}
+	writable chan struct{}
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+func newMuxConn(s *muxSession, id uint32) *muxConn {
+	return &muxConn{
+		id:         id,
+		session:    s,
+		sendWindow: muxWindowSize,
+		readable:   make(chan struct{}, 1),
+		writable:   make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+}
+
+func (c *muxConn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return 0, io.ErrClosedPipe
+		}
+		if len(c.buf) > 0 {
+			n := copy(b, c.buf)
+			c.buf = c.buf[n:]
+			c.consumed += uint32(n)
+			var update uint32
+			if c.consumed >= muxWindowSize/2 && !c.remoteClosed && !c.remoteWriteClosed {
+				update, c.consumed = c.consumed, 0
+			}
+			c.mu.Unlock()
+			if update > 0 {
+				c.session.send(&pb.Packet{Type: pb.Packet_WINDOW, StreamId: c.id, Window: update})
+			}
+			return n, nil
+		}
+		if c.remoteClosed || c.remoteWriteClosed {
+			c.mu.Unlock()
+			return 0, io.EOF
+		}
+		deadline := c.readDeadline
+		c.mu.Unlock()
+
+		if err := c.wait(c.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *muxConn) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		c.mu.Lock()
+		if c.closed || c.remoteClosed || c.writeClosed {
+			c.mu.Unlock()
+			return n, io.ErrClosedPipe
+		}
+		if c.sendWindow == 0 {
+			deadline := c.writeDeadline
+			c.mu.Unlock()
+			if err := c.wait(c.writable, deadline); err != nil {
+				return n, err
+			}
+			continue
+		}
+		size := len(b)
+		if size > maxPacketSize {
+			size = maxPacketSize
+		}
+		if uint32(size) > c.sendWindow {
+			size = int(c.sendWindow)
+		}
+		c.sendWindow -= uint32(size)
+		c.mu.Unlock()
+
+		packet := &pb.Packet{Type: pb.Packet_DATA, StreamId: c.id, Data: b[:size]}
+		if err := c.session.send(packet); err != nil {
+			return n, err
+		}
+		n += size
+		b = b[size:]
+	}
+	return n, nil
+}
+
+// wait blocks until ch is signalled, the conn is done or the deadline exceeded
+func (c *muxConn) wait(ch <-chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case <-ch:
+	case <-c.done:
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+// push appends data received from the peer
+func (c *muxConn) push(data []byte) {
+	c.mu.Lock()
+	c.buf = append(c.buf, data...)
+	c.mu.Unlock()
+	notify(c.readable)
+}
+
+// grow adds the window returned by the peer
+func (c *muxConn) grow(window uint32) {
+	c.mu.Lock()
+	c.sendWindow += window
+	c.mu.Unlock()
+	notify(c.writable)
+}
+
+// closeRemote marks the conn closed by the peer, the buffered data is still readable
+func (c *muxConn) closeRemote() {
+	c.mu.Lock()
+	c.remoteClosed = true
+	c.mu.Unlock()
+	c.doneOnce.Do(func() { close(c.done) })
+}
+
+// closeRemoteWrite marks the write side of the peer closed, the reads get
+// io.EOF after the buffered data
+func (c *muxConn) closeRemoteWrite() {
+	c.mu.Lock()
+	c.remoteWriteClosed = true
+	c.mu.Unlock()
+	notify(c.readable)
+}
+
+// CloseWrite tells the peer no more data is written, the conn is still
+// readable until Close
+func (c *muxConn) CloseWrite() error {
+	c.mu.Lock()
+	if c.closed || c.remoteClosed || c.writeClosed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.writeClosed = true
+	c.mu.Unlock()
+	notify(c.writable)
+	return c.session.send(&pb.Packet{Type: pb.Packet_CLOSE_WRITE, StreamId: c.id})
+}
+
+// Close closes the conn and tells the peer
+func (c *muxConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	remoteClosed := c.remoteClosed
+	c.mu.Unlock()
+	c.doneOnce.Do(func() { close(c.done) })
+
+	c.session.remove(c.id)
+	if !remoteClosed {
+		c.session.send(&pb.Packet{Type: pb.Packet_CLOSE, StreamId: c.id})
+	}
+	return nil
+}
+
+func (c *muxConn) LocalAddr() net.Addr {
+	return muxAddr(c.id)
+}
+
+func (c *muxConn) RemoteAddr() net.Addr {
+	return muxAddr(c.id)
+}
+
+func (c *muxConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.mu.Unlock()
+	notify(c.readable)
+	notify(c.writable)
+	return nil
+}
+
+func (c *muxConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	notify(c.readable)
+	return nil
+}
+
+func (c *muxConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	notify(c.writable)
+	return nil
+}
+
+// notify signals ch without blocking
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// muxAddr is the net.Addr of a logical connection
+type muxAddr uint32
+
+func (a muxAddr) Network() string {
+	return "hypro"
+}
+
+func (a muxAddr) String() string {
+	return "hypro:" + strconv.FormatUint(uint64(a), 10)
+}
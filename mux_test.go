@@ -0,0 +1,119 @@
+package hypro
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	pb "github.com/chuangbo/hypro/protos"
+)
+
+// chanStream is an in-memory packetStream
+type chanStream struct {
+	send chan<- *pb.Packet
+	recv <-chan *pb.Packet
+	ctx  context.Context
+}
+
+func (s *chanStream) Send(p *pb.Packet) error {
+	// copy as grpc serializes the packet before Send returns
+	select {
+	case s.send <- &pb.Packet{Type: p.Type, StreamId: p.StreamId, Window: p.Window, Addr: p.Addr, Data: append([]byte(nil), p.Data...)}:
+		return nil
+	case <-s.ctx.Done():
+		return io.EOF
+	}
+}
+
+func (s *chanStream) Recv() (*pb.Packet, error) {
+	select {
+	case p := <-s.recv:
+		return p, nil
+	case <-s.ctx.Done():
+		return nil, io.EOF
+	}
+}
+
+func (s *chanStream) Context() context.Context {
+	return s.ctx
+}
+
+// newSessionPair returns the opening side and accepting side of a session
+func newSessionPair(t *testing.T) (*muxSession, *muxSession, <-chan net.Conn) {
+	a2b, b2a := make(chan *pb.Packet, 64), make(chan *pb.Packet, 64)
+	ctx, cancel := context.WithCancel(context.Background())
+	accepts := make(chan net.Conn)
+	a := newMuxSession(&chanStream{send: a2b, recv: b2a, ctx: ctx}, nil)
+	b := newMuxSession(&chanStream{send: b2a, recv: a2b, ctx: ctx}, accepts)
+	go a.serve()
+	go b.serve()
+	t.Cleanup(cancel)
+	return a, b, accepts
+}
+
+func Test_muxSession(t *testing.T) {
+	a, _, accepts := newSessionPair(t)
+
+	t.Run("Echo", func(t *testing.T) {
+		conn, err := a.open()
+		if err != nil {
+			t.Fatalf("open() error = %v", err)
+		}
+		peer := <-accepts
+		go io.Copy(peer, peer)
+
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+		got := make([]byte, 5)
+		if _, err := io.ReadFull(conn, got); err != nil || string(got) != "hello" {
+			t.Errorf("Read() = %q, %v, want hello", got, err)
+		}
+		conn.Close()
+	})
+
+	t.Run("Larger than window", func(t *testing.T) {
+		conn, err := a.open()
+		if err != nil {
+			t.Fatalf("open() error = %v", err)
+		}
+		peer := <-accepts
+		want := bytes.Repeat([]byte("0123456789abcdef"), muxWindowSize/4)
+		go func() {
+			conn.Write(want)
+			conn.Close()
+		}()
+		got, err := io.ReadAll(peer)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("ReadAll() = %d bytes, %v, want %d bytes", len(got), err, len(want))
+		}
+	})
+
+	t.Run("Read deadline", func(t *testing.T) {
+		conn, err := a.open()
+		if err != nil {
+			t.Fatalf("open() error = %v", err)
+		}
+		defer conn.Close()
+		<-accepts
+		conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Error("Read() error = nil, want deadline exceeded")
+		}
+	})
+
+	t.Run("Open refused", func(t *testing.T) {
+		_, b, _ := newSessionPair(t)
+		// the accepting side has no peer to open connections
+		conn, err := b.open()
+		if err != nil {
+			t.Fatalf("open() error = %v", err)
+		}
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("Read() error = %v, want EOF", err)
+		}
+	})
+}
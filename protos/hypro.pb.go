@@ -20,6 +20,125 @@ const (
 	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
 )
 
+// Protocol is the traffic carried by the tunnel
+type Protocol int32
+
+const (
+	Protocol_HTTP Protocol = 0
+	Protocol_TCP  Protocol = 1
+	// TLS tunnels are routed by SNI without terminating TLS
+	Protocol_TLS Protocol = 2
+	Protocol_UDP Protocol = 3
+)
+
+// Enum value maps for Protocol.
+var (
+	Protocol_name = map[int32]string{
+		0: "HTTP",
+		1: "TCP",
+		2: "TLS",
+		3: "UDP",
+	}
+	Protocol_value = map[string]int32{
+		"HTTP": 0,
+		"TCP":  1,
+		"TLS":  2,
+		"UDP":  3,
+	}
+)
+
+func (x Protocol) Enum() *Protocol {
+	p := new(Protocol)
+	*p = x
+	return p
+}
+
+func (x Protocol) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Protocol) Descriptor() protoreflect.EnumDescriptor {
+	return file_protos_hypro_proto_enumTypes[0].Descriptor()
+}
+
+func (Protocol) Type() protoreflect.EnumType {
+	return &file_protos_hypro_proto_enumTypes[0]
+}
+
+func (x Protocol) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Protocol.Descriptor instead.
+func (Protocol) EnumDescriptor() ([]byte, []int) {
+	return file_protos_hypro_proto_rawDescGZIP(), []int{0}
+}
+
+type Packet_Type int32
+
+const (
+	Packet_DATA   Packet_Type = 0
+	Packet_OPEN   Packet_Type = 1
+	Packet_CLOSE  Packet_Type = 2
+	Packet_WINDOW Packet_Type = 3
+	// GOAWAY tells the peer to open no more connections on the tunnel
+	Packet_GOAWAY Packet_Type = 4
+	// DATAGRAM carries a datagram of a UDP tunnel
+	Packet_DATAGRAM Packet_Type = 5
+	// CLOSE_WRITE tells the peer no more DATA is sent on the connection,
+	// the other direction keeps going until CLOSE
+	Packet_CLOSE_WRITE Packet_Type = 6
+)
+
+// Enum value maps for Packet_Type.
+var (
+	Packet_Type_name = map[int32]string{
+		0: "DATA",
+		1: "OPEN",
+		2: "CLOSE",
+		3: "WINDOW",
+		4: "GOAWAY",
+		5: "DATAGRAM",
+		6: "CLOSE_WRITE",
+	}
+	Packet_Type_value = map[string]int32{
+		"DATA":        0,
+		"OPEN":        1,
+		"CLOSE":       2,
+		"WINDOW":      3,
+		"GOAWAY":      4,
+		"DATAGRAM":    5,
+		"CLOSE_WRITE": 6,
+	}
+)
+
+func (x Packet_Type) Enum() *Packet_Type {
+	p := new(Packet_Type)
+	*p = x
+	return p
+}
+
+func (x Packet_Type) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Packet_Type) Descriptor() protoreflect.EnumDescriptor {
+	return file_protos_hypro_proto_enumTypes[1].Descriptor()
+}
+
+func (Packet_Type) Type() protoreflect.EnumType {
+	return &file_protos_hypro_proto_enumTypes[1]
+}
+
+func (x Packet_Type) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Packet_Type.Descriptor instead.
+func (Packet_Type) EnumDescriptor() ([]byte, []int) {
+	return file_protos_hypro_proto_rawDescGZIP(), []int{6, 0}
+}
+
 type CheckVersionRequest struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -136,6 +255,15 @@ type RegisterRequest struct {
 	unknownFields protoimpl.UnknownFields
 
 	Domain string `protobuf:"bytes,10,opt,name=domain,proto3" json:"domain,omitempty"`
+	// token of the previous registration, to reclaim the domain on reconnect
+	Token    string   `protobuf:"bytes,20,opt,name=token,proto3" json:"token,omitempty"`
+	Protocol Protocol `protobuf:"varint,30,opt,name=protocol,proto3,enum=protos.Protocol" json:"protocol,omitempty"`
+	// port is the public port requested by a TCP or UDP tunnel,
+	// assigned by the server if zero
+	Port uint32 `protobuf:"varint,40,opt,name=port,proto3" json:"port,omitempty"`
+	// h2c tells the server the client serves h2c with prior knowledge
+	// on the tunnel connections
+	H2C bool `protobuf:"varint,50,opt,name=h2c,proto3" json:"h2c,omitempty"`
 }
 
 func (x *RegisterRequest) Reset() {
@@ -177,6 +305,34 @@ func (x *RegisterRequest) GetDomain() string {
 	return ""
 }
 
+func (x *RegisterRequest) GetToken() string {
+	if x != nil {
+		return x.Token
+	}
+	return ""
+}
+
+func (x *RegisterRequest) GetProtocol() Protocol {
+	if x != nil {
+		return x.Protocol
+	}
+	return Protocol_HTTP
+}
+
+func (x *RegisterRequest) GetPort() uint32 {
+	if x != nil {
+		return x.Port
+	}
+	return 0
+}
+
+func (x *RegisterRequest) GetH2C() bool {
+	if x != nil {
+		return x.H2C
+	}
+	return false
+}
+
 type RegisterResponse struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -184,6 +340,11 @@ type RegisterResponse struct {
 
 	Token      string `protobuf:"bytes,10,opt,name=token,proto3" json:"token,omitempty"`
 	FullDomain string `protobuf:"bytes,20,opt,name=full_domain,json=fullDomain,proto3" json:"full_domain,omitempty"`
+	// domain is the registered domain, assigned by the server if the
+	// request domain is empty
+	Domain string `protobuf:"bytes,30,opt,name=domain,proto3" json:"domain,omitempty"`
+	// port is the public port of a TCP or UDP tunnel
+	Port uint32 `protobuf:"varint,40,opt,name=port,proto3" json:"port,omitempty"`
 }
 
 func (x *RegisterResponse) Reset() {
@@ -232,18 +393,132 @@ func (x *RegisterResponse) GetFullDomain() string {
 	return ""
 }
 
+func (x *RegisterResponse) GetDomain() string {
+	if x != nil {
+		return x.Domain
+	}
+	return ""
+}
+
+func (x *RegisterResponse) GetPort() uint32 {
+	if x != nil {
+		return x.Port
+	}
+	return 0
+}
+
+type UnregisterRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Domain string `protobuf:"bytes,10,opt,name=domain,proto3" json:"domain,omitempty"`
+	Token  string `protobuf:"bytes,20,opt,name=token,proto3" json:"token,omitempty"`
+}
+
+func (x *UnregisterRequest) Reset() {
+	*x = UnregisterRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_protos_hypro_proto_msgTypes[4]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *UnregisterRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UnregisterRequest) ProtoMessage() {}
+
+func (x *UnregisterRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_protos_hypro_proto_msgTypes[4]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UnregisterRequest.ProtoReflect.Descriptor instead.
+func (*UnregisterRequest) Descriptor() ([]byte, []int) {
+	return file_protos_hypro_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *UnregisterRequest) GetDomain() string {
+	if x != nil {
+		return x.Domain
+	}
+	return ""
+}
+
+func (x *UnregisterRequest) GetToken() string {
+	if x != nil {
+		return x.Token
+	}
+	return ""
+}
+
+type UnregisterResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+}
+
+func (x *UnregisterResponse) Reset() {
+	*x = UnregisterResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_protos_hypro_proto_msgTypes[5]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *UnregisterResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UnregisterResponse) ProtoMessage() {}
+
+func (x *UnregisterResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_protos_hypro_proto_msgTypes[5]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UnregisterResponse.ProtoReflect.Descriptor instead.
+func (*UnregisterResponse) Descriptor() ([]byte, []int) {
+	return file_protos_hypro_proto_rawDescGZIP(), []int{5}
+}
+
 type Packet struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
 	Data []byte `protobuf:"bytes,10,opt,name=data,proto3" json:"data,omitempty"`
+	// stream_id, type and window frame the logical connections
+	// of a multiplexed tunnel
+	StreamId uint32      `protobuf:"varint,20,opt,name=stream_id,json=streamId,proto3" json:"stream_id,omitempty"`
+	Type     Packet_Type `protobuf:"varint,30,opt,name=type,proto3,enum=protos.Packet_Type" json:"type,omitempty"`
+	Window   uint32      `protobuf:"varint,40,opt,name=window,proto3" json:"window,omitempty"`
+	// addr is the remote peer of a DATAGRAM
+	Addr string `protobuf:"bytes,50,opt,name=addr,proto3" json:"addr,omitempty"`
 }
 
 func (x *Packet) Reset() {
 	*x = Packet{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_protos_hypro_proto_msgTypes[4]
+		mi := &file_protos_hypro_proto_msgTypes[6]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -256,7 +531,7 @@ func (x *Packet) String() string {
 func (*Packet) ProtoMessage() {}
 
 func (x *Packet) ProtoReflect() protoreflect.Message {
-	mi := &file_protos_hypro_proto_msgTypes[4]
+	mi := &file_protos_hypro_proto_msgTypes[6]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -269,7 +544,7 @@ func (x *Packet) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use Packet.ProtoReflect.Descriptor instead.
 func (*Packet) Descriptor() ([]byte, []int) {
-	return file_protos_hypro_proto_rawDescGZIP(), []int{4}
+	return file_protos_hypro_proto_rawDescGZIP(), []int{6}
 }
 
 func (x *Packet) GetData() []byte {
@@ -279,6 +554,34 @@ func (x *Packet) GetData() []byte {
 	return nil
 }
 
+func (x *Packet) GetStreamId() uint32 {
+	if x != nil {
+		return x.StreamId
+	}
+	return 0
+}
+
+func (x *Packet) GetType() Packet_Type {
+	if x != nil {
+		return x.Type
+	}
+	return Packet_DATA
+}
+
+func (x *Packet) GetWindow() uint32 {
+	if x != nil {
+		return x.Window
+	}
+	return 0
+}
+
+func (x *Packet) GetAddr() string {
+	if x != nil {
+		return x.Addr
+	}
+	return ""
+}
+
 var File_protos_hypro_proto protoreflect.FileDescriptor
 
 var file_protos_hypro_proto_rawDesc = []byte{
@@ -295,32 +598,67 @@ var file_protos_hypro_proto_rawDesc = []byte{
 	0x73, 0x69, 0x6f, 0x6e, 0x18, 0x14, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0d, 0x73, 0x65, 0x72, 0x76,
 	0x65, 0x72, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x1f, 0x0a, 0x0b, 0x6d, 0x69, 0x6e,
 	0x5f, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x1e, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0a,
-	0x6d, 0x69, 0x6e, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x22, 0x29, 0x0a, 0x0f, 0x52, 0x65,
-	0x67, 0x69, 0x73, 0x74, 0x65, 0x72, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x16, 0x0a,
-	0x06, 0x64, 0x6f, 0x6d, 0x61, 0x69, 0x6e, 0x18, 0x0a, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x64,
-	0x6f, 0x6d, 0x61, 0x69, 0x6e, 0x22, 0x49, 0x0a, 0x10, 0x52, 0x65, 0x67, 0x69, 0x73, 0x74, 0x65,
-	0x72, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x14, 0x0a, 0x05, 0x74, 0x6f, 0x6b,
-	0x65, 0x6e, 0x18, 0x0a, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x74, 0x6f, 0x6b, 0x65, 0x6e, 0x12,
-	0x1f, 0x0a, 0x0b, 0x66, 0x75, 0x6c, 0x6c, 0x5f, 0x64, 0x6f, 0x6d, 0x61, 0x69, 0x6e, 0x18, 0x14,
-	0x20, 0x01, 0x28, 0x09, 0x52, 0x0a, 0x66, 0x75, 0x6c, 0x6c, 0x44, 0x6f, 0x6d, 0x61, 0x69, 0x6e,
-	0x22, 0x1c, 0x0a, 0x06, 0x50, 0x61, 0x63, 0x6b, 0x65, 0x74, 0x12, 0x12, 0x0a, 0x04, 0x64, 0x61,
-	0x74, 0x61, 0x18, 0x0a, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x64, 0x61, 0x74, 0x61, 0x32, 0xc6,
-	0x01, 0x0a, 0x06, 0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x12, 0x49, 0x0a, 0x0c, 0x43, 0x68, 0x65,
-	0x63, 0x6b, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x1b, 0x2e, 0x70, 0x72, 0x6f, 0x74,
-	0x6f, 0x73, 0x2e, 0x43, 0x68, 0x65, 0x63, 0x6b, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x52,
-	0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x1c, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x73, 0x2e,
-	0x43, 0x68, 0x65, 0x63, 0x6b, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x52, 0x65, 0x73, 0x70,
-	0x6f, 0x6e, 0x73, 0x65, 0x12, 0x3d, 0x0a, 0x08, 0x52, 0x65, 0x67, 0x69, 0x73, 0x74, 0x65, 0x72,
-	0x12, 0x17, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x73, 0x2e, 0x52, 0x65, 0x67, 0x69, 0x73, 0x74,
-	0x65, 0x72, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x18, 0x2e, 0x70, 0x72, 0x6f, 0x74,
-	0x6f, 0x73, 0x2e, 0x52, 0x65, 0x67, 0x69, 0x73, 0x74, 0x65, 0x72, 0x52, 0x65, 0x73, 0x70, 0x6f,
-	0x6e, 0x73, 0x65, 0x12, 0x32, 0x0a, 0x0c, 0x43, 0x72, 0x65, 0x61, 0x74, 0x65, 0x54, 0x75, 0x6e,
-	0x6e, 0x65, 0x6c, 0x12, 0x0e, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x73, 0x2e, 0x50, 0x61, 0x63,
-	0x6b, 0x65, 0x74, 0x1a, 0x0e, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x73, 0x2e, 0x50, 0x61, 0x63,
-	0x6b, 0x65, 0x74, 0x28, 0x01, 0x30, 0x01, 0x42, 0x22, 0x5a, 0x20, 0x67, 0x69, 0x74, 0x68, 0x75,
-	0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x63, 0x68, 0x75, 0x61, 0x6e, 0x67, 0x62, 0x6f, 0x2f, 0x68,
-	0x79, 0x70, 0x72, 0x6f, 0x2f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x73, 0x62, 0x06, 0x70, 0x72, 0x6f,
-	0x74, 0x6f, 0x33,
+	0x6d, 0x69, 0x6e, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x22, 0x93, 0x01, 0x0a, 0x0f, 0x52,
+	0x65, 0x67, 0x69, 0x73, 0x74, 0x65, 0x72, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x16,
+	0x0a, 0x06, 0x64, 0x6f, 0x6d, 0x61, 0x69, 0x6e, 0x18, 0x0a, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06,
+	0x64, 0x6f, 0x6d, 0x61, 0x69, 0x6e, 0x12, 0x14, 0x0a, 0x05, 0x74, 0x6f, 0x6b, 0x65, 0x6e, 0x18,
+	0x14, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x74, 0x6f, 0x6b, 0x65, 0x6e, 0x12, 0x2c, 0x0a, 0x08,
+	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x63, 0x6f, 0x6c, 0x18, 0x1e, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x10,
+	0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x73, 0x2e, 0x50, 0x72, 0x6f, 0x74, 0x6f, 0x63, 0x6f, 0x6c,
+	0x52, 0x08, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x63, 0x6f, 0x6c, 0x12, 0x12, 0x0a, 0x04, 0x70, 0x6f,
+	0x72, 0x74, 0x18, 0x28, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x04, 0x70, 0x6f, 0x72, 0x74, 0x12, 0x10,
+	0x0a, 0x03, 0x68, 0x32, 0x63, 0x18, 0x32, 0x20, 0x01, 0x28, 0x08, 0x52, 0x03, 0x68, 0x32, 0x63,
+	0x22, 0x75, 0x0a, 0x10, 0x52, 0x65, 0x67, 0x69, 0x73, 0x74, 0x65, 0x72, 0x52, 0x65, 0x73, 0x70,
+	0x6f, 0x6e, 0x73, 0x65, 0x12, 0x14, 0x0a, 0x05, 0x74, 0x6f, 0x6b, 0x65, 0x6e, 0x18, 0x0a, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x05, 0x74, 0x6f, 0x6b, 0x65, 0x6e, 0x12, 0x1f, 0x0a, 0x0b, 0x66, 0x75,
+	0x6c, 0x6c, 0x5f, 0x64, 0x6f, 0x6d, 0x61, 0x69, 0x6e, 0x18, 0x14, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x0a, 0x66, 0x75, 0x6c, 0x6c, 0x44, 0x6f, 0x6d, 0x61, 0x69, 0x6e, 0x12, 0x16, 0x0a, 0x06, 0x64,
+	0x6f, 0x6d, 0x61, 0x69, 0x6e, 0x18, 0x1e, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x64, 0x6f, 0x6d,
+	0x61, 0x69, 0x6e, 0x12, 0x12, 0x0a, 0x04, 0x70, 0x6f, 0x72, 0x74, 0x18, 0x28, 0x20, 0x01, 0x28,
+	0x0d, 0x52, 0x04, 0x70, 0x6f, 0x72, 0x74, 0x22, 0x41, 0x0a, 0x11, 0x55, 0x6e, 0x72, 0x65, 0x67,
+	0x69, 0x73, 0x74, 0x65, 0x72, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x16, 0x0a, 0x06,
+	0x64, 0x6f, 0x6d, 0x61, 0x69, 0x6e, 0x18, 0x0a, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x64, 0x6f,
+	0x6d, 0x61, 0x69, 0x6e, 0x12, 0x14, 0x0a, 0x05, 0x74, 0x6f, 0x6b, 0x65, 0x6e, 0x18, 0x14, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x05, 0x74, 0x6f, 0x6b, 0x65, 0x6e, 0x22, 0x14, 0x0a, 0x12, 0x55, 0x6e,
+	0x72, 0x65, 0x67, 0x69, 0x73, 0x74, 0x65, 0x72, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65,
+	0x22, 0xec, 0x01, 0x0a, 0x06, 0x50, 0x61, 0x63, 0x6b, 0x65, 0x74, 0x12, 0x12, 0x0a, 0x04, 0x64,
+	0x61, 0x74, 0x61, 0x18, 0x0a, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x64, 0x61, 0x74, 0x61, 0x12,
+	0x1b, 0x0a, 0x09, 0x73, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x5f, 0x69, 0x64, 0x18, 0x14, 0x20, 0x01,
+	0x28, 0x0d, 0x52, 0x08, 0x73, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x49, 0x64, 0x12, 0x27, 0x0a, 0x04,
+	0x74, 0x79, 0x70, 0x65, 0x18, 0x1e, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x13, 0x2e, 0x70, 0x72, 0x6f,
+	0x74, 0x6f, 0x73, 0x2e, 0x50, 0x61, 0x63, 0x6b, 0x65, 0x74, 0x2e, 0x54, 0x79, 0x70, 0x65, 0x52,
+	0x04, 0x74, 0x79, 0x70, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x77, 0x69, 0x6e, 0x64, 0x6f, 0x77, 0x18,
+	0x28, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x06, 0x77, 0x69, 0x6e, 0x64, 0x6f, 0x77, 0x12, 0x12, 0x0a,
+	0x04, 0x61, 0x64, 0x64, 0x72, 0x18, 0x32, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x61, 0x64, 0x64,
+	0x72, 0x22, 0x5c, 0x0a, 0x04, 0x54, 0x79, 0x70, 0x65, 0x12, 0x08, 0x0a, 0x04, 0x44, 0x41, 0x54,
+	0x41, 0x10, 0x00, 0x12, 0x08, 0x0a, 0x04, 0x4f, 0x50, 0x45, 0x4e, 0x10, 0x01, 0x12, 0x09, 0x0a,
+	0x05, 0x43, 0x4c, 0x4f, 0x53, 0x45, 0x10, 0x02, 0x12, 0x0a, 0x0a, 0x06, 0x57, 0x49, 0x4e, 0x44,
+	0x4f, 0x57, 0x10, 0x03, 0x12, 0x0a, 0x0a, 0x06, 0x47, 0x4f, 0x41, 0x57, 0x41, 0x59, 0x10, 0x04,
+	0x12, 0x0c, 0x0a, 0x08, 0x44, 0x41, 0x54, 0x41, 0x47, 0x52, 0x41, 0x4d, 0x10, 0x05, 0x12, 0x0f,
+	0x0a, 0x0b, 0x43, 0x4c, 0x4f, 0x53, 0x45, 0x5f, 0x57, 0x52, 0x49, 0x54, 0x45, 0x10, 0x06, 0x2a,
+	0x2f, 0x0a, 0x08, 0x50, 0x72, 0x6f, 0x74, 0x6f, 0x63, 0x6f, 0x6c, 0x12, 0x08, 0x0a, 0x04, 0x48,
+	0x54, 0x54, 0x50, 0x10, 0x00, 0x12, 0x07, 0x0a, 0x03, 0x54, 0x43, 0x50, 0x10, 0x01, 0x12, 0x07,
+	0x0a, 0x03, 0x54, 0x4c, 0x53, 0x10, 0x02, 0x12, 0x07, 0x0a, 0x03, 0x55, 0x44, 0x50, 0x10, 0x03,
+	0x32, 0x8b, 0x02, 0x0a, 0x06, 0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x12, 0x49, 0x0a, 0x0c, 0x43,
+	0x68, 0x65, 0x63, 0x6b, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x1b, 0x2e, 0x70, 0x72,
+	0x6f, 0x74, 0x6f, 0x73, 0x2e, 0x43, 0x68, 0x65, 0x63, 0x6b, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f,
+	0x6e, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x1c, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f,
+	0x73, 0x2e, 0x43, 0x68, 0x65, 0x63, 0x6b, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x52, 0x65,
+	0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x3d, 0x0a, 0x08, 0x52, 0x65, 0x67, 0x69, 0x73, 0x74,
+	0x65, 0x72, 0x12, 0x17, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x73, 0x2e, 0x52, 0x65, 0x67, 0x69,
+	0x73, 0x74, 0x65, 0x72, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x18, 0x2e, 0x70, 0x72,
+	0x6f, 0x74, 0x6f, 0x73, 0x2e, 0x52, 0x65, 0x67, 0x69, 0x73, 0x74, 0x65, 0x72, 0x52, 0x65, 0x73,
+	0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x32, 0x0a, 0x0c, 0x43, 0x72, 0x65, 0x61, 0x74, 0x65, 0x54,
+	0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x12, 0x0e, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x73, 0x2e, 0x50,
+	0x61, 0x63, 0x6b, 0x65, 0x74, 0x1a, 0x0e, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x73, 0x2e, 0x50,
+	0x61, 0x63, 0x6b, 0x65, 0x74, 0x28, 0x01, 0x30, 0x01, 0x12, 0x43, 0x0a, 0x0a, 0x55, 0x6e, 0x72,
+	0x65, 0x67, 0x69, 0x73, 0x74, 0x65, 0x72, 0x12, 0x19, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x73,
+	0x2e, 0x55, 0x6e, 0x72, 0x65, 0x67, 0x69, 0x73, 0x74, 0x65, 0x72, 0x52, 0x65, 0x71, 0x75, 0x65,
+	0x73, 0x74, 0x1a, 0x1a, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x73, 0x2e, 0x55, 0x6e, 0x72, 0x65,
+	0x67, 0x69, 0x73, 0x74, 0x65, 0x72, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x42, 0x22,
+	0x5a, 0x20, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x63, 0x68, 0x75,
+	0x61, 0x6e, 0x67, 0x62, 0x6f, 0x2f, 0x68, 0x79, 0x70, 0x72, 0x6f, 0x2f, 0x70, 0x72, 0x6f, 0x74,
+	0x6f, 0x73, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -335,26 +673,35 @@ func file_protos_hypro_proto_rawDescGZIP() []byte {
 	return file_protos_hypro_proto_rawDescData
 }
 
-var file_protos_hypro_proto_msgTypes = make([]protoimpl.MessageInfo, 5)
+var file_protos_hypro_proto_enumTypes = make([]protoimpl.EnumInfo, 2)
+var file_protos_hypro_proto_msgTypes = make([]protoimpl.MessageInfo, 7)
 var file_protos_hypro_proto_goTypes = []any{
-	(*CheckVersionRequest)(nil),  // 0: protos.CheckVersionRequest
-	(*CheckVersionResponse)(nil), // 1: protos.CheckVersionResponse
-	(*RegisterRequest)(nil),      // 2: protos.RegisterRequest
-	(*RegisterResponse)(nil),     // 3: protos.RegisterResponse
-	(*Packet)(nil),               // 4: protos.Packet
+	(Protocol)(0),                // 0: protos.Protocol
+	(Packet_Type)(0),             // 1: protos.Packet.Type
+	(*CheckVersionRequest)(nil),  // 2: protos.CheckVersionRequest
+	(*CheckVersionResponse)(nil), // 3: protos.CheckVersionResponse
+	(*RegisterRequest)(nil),      // 4: protos.RegisterRequest
+	(*RegisterResponse)(nil),     // 5: protos.RegisterResponse
+	(*UnregisterRequest)(nil),    // 6: protos.UnregisterRequest
+	(*UnregisterResponse)(nil),   // 7: protos.UnregisterResponse
+	(*Packet)(nil),               // 8: protos.Packet
 }
 var file_protos_hypro_proto_depIdxs = []int32{
-	0, // 0: protos.Tunnel.CheckVersion:input_type -> protos.CheckVersionRequest
-	2, // 1: protos.Tunnel.Register:input_type -> protos.RegisterRequest
-	4, // 2: protos.Tunnel.CreateTunnel:input_type -> protos.Packet
-	1, // 3: protos.Tunnel.CheckVersion:output_type -> protos.CheckVersionResponse
-	3, // 4: protos.Tunnel.Register:output_type -> protos.RegisterResponse
-	4, // 5: protos.Tunnel.CreateTunnel:output_type -> protos.Packet
-	3, // [3:6] is the sub-list for method output_type
-	0, // [0:3] is the sub-list for method input_type
-	0, // [0:0] is the sub-list for extension type_name
-	0, // [0:0] is the sub-list for extension extendee
-	0, // [0:0] is the sub-list for field type_name
+	0, // 0: protos.RegisterRequest.protocol:type_name -> protos.Protocol
+	1, // 1: protos.Packet.type:type_name -> protos.Packet.Type
+	2, // 2: protos.Tunnel.CheckVersion:input_type -> protos.CheckVersionRequest
+	4, // 3: protos.Tunnel.Register:input_type -> protos.RegisterRequest
+	8, // 4: protos.Tunnel.CreateTunnel:input_type -> protos.Packet
+	6, // 5: protos.Tunnel.Unregister:input_type -> protos.UnregisterRequest
+	3, // 6: protos.Tunnel.CheckVersion:output_type -> protos.CheckVersionResponse
+	5, // 7: protos.Tunnel.Register:output_type -> protos.RegisterResponse
+	8, // 8: protos.Tunnel.CreateTunnel:output_type -> protos.Packet
+	7, // 9: protos.Tunnel.Unregister:output_type -> protos.UnregisterResponse
+	6, // [6:10] is the sub-list for method output_type
+	2, // [2:6] is the sub-list for method input_type
+	2, // [2:2] is the sub-list for extension type_name
+	2, // [2:2] is the sub-list for extension extendee
+	0, // [0:2] is the sub-list for field type_name
 }
 
 func init() { file_protos_hypro_proto_init() }
@@ -412,6 +759,30 @@ func file_protos_hypro_proto_init() {
 			}
 		}
 		file_protos_hypro_proto_msgTypes[4].Exporter = func(v any, i int) any {
+			switch v := v.(*UnregisterRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_protos_hypro_proto_msgTypes[5].Exporter = func(v any, i int) any {
+			switch v := v.(*UnregisterResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_protos_hypro_proto_msgTypes[6].Exporter = func(v any, i int) any {
 			switch v := v.(*Packet); i {
 			case 0:
 				return &v.state
@@ -429,13 +800,14 @@ func file_protos_hypro_proto_init() {
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_protos_hypro_proto_rawDesc,
-			NumEnums:      0,
-			NumMessages:   5,
+			NumEnums:      2,
+			NumMessages:   7,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
 		GoTypes:           file_protos_hypro_proto_goTypes,
 		DependencyIndexes: file_protos_hypro_proto_depIdxs,
+		EnumInfos:         file_protos_hypro_proto_enumTypes,
 		MessageInfos:      file_protos_hypro_proto_msgTypes,
 	}.Build()
 	File_protos_hypro_proto = out.File
@@ -22,6 +22,7 @@ const (
 	Tunnel_CheckVersion_FullMethodName = "/protos.Tunnel/CheckVersion"
 	Tunnel_Register_FullMethodName     = "/protos.Tunnel/Register"
 	Tunnel_CreateTunnel_FullMethodName = "/protos.Tunnel/CreateTunnel"
+	Tunnel_Unregister_FullMethodName   = "/protos.Tunnel/Unregister"
 )
 
 // TunnelClient is the client API for Tunnel service.
@@ -31,6 +32,7 @@ type TunnelClient interface {
 	CheckVersion(ctx context.Context, in *CheckVersionRequest, opts ...grpc.CallOption) (*CheckVersionResponse, error)
 	Register(ctx context.Context, in *RegisterRequest, opts ...grpc.CallOption) (*RegisterResponse, error)
 	CreateTunnel(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[Packet, Packet], error)
+	Unregister(ctx context.Context, in *UnregisterRequest, opts ...grpc.CallOption) (*UnregisterResponse, error)
 }
 
 type tunnelClient struct {
@@ -74,6 +76,16 @@ func (c *tunnelClient) CreateTunnel(ctx context.Context, opts ...grpc.CallOption
 // This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
 type Tunnel_CreateTunnelClient = grpc.BidiStreamingClient[Packet, Packet]
 
+func (c *tunnelClient) Unregister(ctx context.Context, in *UnregisterRequest, opts ...grpc.CallOption) (*UnregisterResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(UnregisterResponse)
+	err := c.cc.Invoke(ctx, Tunnel_Unregister_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // TunnelServer is the server API for Tunnel service.
 // All implementations must embed UnimplementedTunnelServer
 // for forward compatibility.
@@ -81,6 +93,7 @@ type TunnelServer interface {
 	CheckVersion(context.Context, *CheckVersionRequest) (*CheckVersionResponse, error)
 	Register(context.Context, *RegisterRequest) (*RegisterResponse, error)
 	CreateTunnel(grpc.BidiStreamingServer[Packet, Packet]) error
+	Unregister(context.Context, *UnregisterRequest) (*UnregisterResponse, error)
 	mustEmbedUnimplementedTunnelServer()
 }
 
@@ -100,6 +113,9 @@ func (UnimplementedTunnelServer) Register(context.Context, *RegisterRequest) (*R
 func (UnimplementedTunnelServer) CreateTunnel(grpc.BidiStreamingServer[Packet, Packet]) error {
 	return status.Errorf(codes.Unimplemented, "method CreateTunnel not implemented")
 }
+func (UnimplementedTunnelServer) Unregister(context.Context, *UnregisterRequest) (*UnregisterResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Unregister not implemented")
+}
 func (UnimplementedTunnelServer) mustEmbedUnimplementedTunnelServer() {}
 func (UnimplementedTunnelServer) testEmbeddedByValue()                {}
 
@@ -164,6 +180,24 @@ func _Tunnel_CreateTunnel_Handler(srv interface{}, stream grpc.ServerStream) err
 // This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
 type Tunnel_CreateTunnelServer = grpc.BidiStreamingServer[Packet, Packet]
 
+func _Tunnel_Unregister_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UnregisterRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TunnelServer).Unregister(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Tunnel_Unregister_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TunnelServer).Unregister(ctx, req.(*UnregisterRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // Tunnel_ServiceDesc is the grpc.ServiceDesc for Tunnel service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -179,6 +213,10 @@ var Tunnel_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "Register",
 			Handler:    _Tunnel_Register_Handler,
 		},
+		{
+			MethodName: "Unregister",
+			Handler:    _Tunnel_Unregister_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
@@ -0,0 +1,118 @@
+package hypro
+
+import (
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	maxDomainLength = 253
+	maxLabelLength  = 63
+
+	// randomLabelLength is the length of the subdomain assigned to
+	// the clients registering without a domain
+	randomLabelLength = 8
+)
+
+// RegisterPolicy decides which domains the clients could register
+type RegisterPolicy struct {
+	// Suffixes are the allowed base domains, e.g. example.com allows
+	// myapp.example.com but not example.com itself. Any valid domain
+	// could be registered if empty
+	Suffixes []string
+
+	// Reserved are the subdomain names which could not be registered,
+	// e.g. www reserves www.example.com
+	Reserved []string
+}
+
+// check returns InvalidArgument if the domain is not a valid host name,
+// or PermissionDenied if the policy does not allow it
+func (p *RegisterPolicy) check(domain string) error {
+	if err := validateDomain(domain); err != nil {
+		return err
+	}
+	if p == nil {
+		return nil
+	}
+
+	name := domain
+	if len(p.Suffixes) > 0 {
+		name = ""
+		for _, suffix := range p.Suffixes {
+			if sub := strings.TrimSuffix(domain, "."+suffix); sub != domain {
+				name = sub
+				break
+			}
+		}
+		if name == "" {
+			return status.Errorf(codes.PermissionDenied, "domain %s is not under %s", domain, strings.Join(p.Suffixes, ", "))
+		}
+	}
+
+	// the reserved names are checked on the label right below the suffix,
+	// or the leftmost label without suffixes
+	label := name[strings.LastIndex(name, ".")+1:]
+	if len(p.Suffixes) == 0 {
+		label = name[:strings.Index(name+".", ".")]
+	}
+	for _, reserved := range p.Reserved {
+		if label == reserved {
+			return status.Errorf(codes.PermissionDenied, "domain %s is reserved", domain)
+		}
+	}
+	return nil
+}
+
+// randomDomain returns a random subdomain of the first suffix
+func (p *RegisterPolicy) randomDomain() (string, error) {
+	if p == nil || len(p.Suffixes) == 0 {
+		return "", status.Errorf(codes.InvalidArgument, "domain is required")
+	}
+	label, err := generateRandomLabel(randomLabelLength)
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "could not create domain")
+	}
+	return label + "." + p.Suffixes[0], nil
+}
+
+// validateDomain checks the domain is made of valid DNS labels
+func validateDomain(domain string) error {
+	if domain == "" || len(domain) > maxDomainLength {
+		return status.Errorf(codes.InvalidArgument, "invalid domain length %q", domain)
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if !validLabel(label) {
+			return status.Errorf(codes.InvalidArgument, "invalid domain %q", domain)
+		}
+	}
+	return nil
+}
+
+// validLabel reports whether the label has 1 to 63 letters, digits or
+// hyphens, and does not start or end with a hyphen
+func validLabel(label string) bool {
+	if label == "" || len(label) > maxLabelLength ||
+		label[0] == '-' || label[len(label)-1] == '-' {
+		return false
+	}
+	for _, r := range label {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// matchDomain reports whether the domain matches the pattern, which is
+// either the exact domain or a wildcard like *.example.com matching one label
+func matchDomain(pattern, domain string) bool {
+	pattern = strings.ToLower(pattern)
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		label, rest, found := strings.Cut(domain, ".")
+		return found && label != "" && rest == suffix
+	}
+	return pattern == domain
+}
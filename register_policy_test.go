@@ -0,0 +1,84 @@
+package hypro
+
+import (
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRegisterPolicy_check(t *testing.T) {
+	policy := &RegisterPolicy{
+		Suffixes: []string{"example.com"},
+		Reserved: []string{"www", "admin"},
+	}
+	tests := []struct {
+		name   string
+		policy *RegisterPolicy
+		domain string
+		want   codes.Code
+	}{
+		{"Subdomain", policy, "myapp.example.com", codes.OK},
+		{"Nested subdomain", policy, "a.myapp.example.com", codes.OK},
+		{"Base domain", policy, "example.com", codes.PermissionDenied},
+		{"Other domain", policy, "example.org", codes.PermissionDenied},
+		{"Lookalike domain", policy, "myapp.badexample.com", codes.PermissionDenied},
+		{"Reserved", policy, "www.example.com", codes.PermissionDenied},
+		{"Reserved nested", policy, "a.admin.example.com", codes.PermissionDenied},
+		{"Space", policy, "a b.example.com", codes.InvalidArgument},
+		{"Empty label", policy, "a..example.com", codes.InvalidArgument},
+		{"Leading hyphen", policy, "-a.example.com", codes.InvalidArgument},
+		{"Long label", policy, strings.Repeat("a", 64) + ".example.com", codes.InvalidArgument},
+		{"Reserved without suffix", &RegisterPolicy{Reserved: []string{"www"}}, "www.example.org", codes.PermissionDenied},
+		{"Without suffix", &RegisterPolicy{Reserved: []string{"www"}}, "myapp.example.org", codes.OK},
+		{"No policy", nil, "example.com", codes.OK},
+		{"No policy invalid", nil, "a_b.example.com", codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.check(tt.domain)
+			if got := status.Code(err); got != tt.want {
+				t.Errorf("check() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegisterPolicy_randomDomain(t *testing.T) {
+	policy := &RegisterPolicy{Suffixes: []string{"example.com"}}
+	domain, err := policy.randomDomain()
+	if err != nil {
+		t.Fatalf("randomDomain() error = %v", err)
+	}
+	if err := policy.check(domain); err != nil {
+		t.Errorf("randomDomain() = %s, check() error = %v", domain, err)
+	}
+
+	if _, err := (&RegisterPolicy{}).randomDomain(); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("randomDomain() without suffix error = %v, want InvalidArgument", err)
+	}
+}
+
+func Test_matchDomain(t *testing.T) {
+	tests := []struct {
+		name            string
+		pattern, domain string
+		want            bool
+	}{
+		{"Exact", "myapp.example.com", "myapp.example.com", true},
+		{"Exact mismatch", "myapp.example.com", "other.example.com", false},
+		{"Case insensitive", "MyApp.Example.com", "myapp.example.com", true},
+		{"Wildcard", "*.example.com", "myapp.example.com", true},
+		{"Wildcard base", "*.example.com", "example.com", false},
+		{"Wildcard one label", "*.example.com", "a.myapp.example.com", false},
+		{"Wildcard lookalike", "*.example.com", "myapp.badexample.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchDomain(tt.pattern, tt.domain); got != tt.want {
+				t.Errorf("matchDomain() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package hypro
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Route forwards the requests of the matched paths to its target
+type Route struct {
+	// Path matches the requests by the prefix of their path, e.g. /api/
+	Path string `yaml:"path" toml:"path"`
+
+	// Regexp matches the requests by their path instead of Path, e.g. ^/v[0-9]+/
+	Regexp string `yaml:"regexp" toml:"regexp"`
+
+	// Target is forwarded to, e.g. http://localhost:8080 or grpc://localhost:50051
+	Target string `yaml:"target" toml:"target"`
+
+	// StripPrefix removes the matched prefix from the path before forwarding,
+	// a Regexp strips the match at the start of the path
+	StripPrefix bool `yaml:"strip_prefix" toml:"strip_prefix"`
+
+	// Host is the Host header sent to the target, the tunnel domain is kept
+	// if it is empty
+	Host string `yaml:"host" toml:"host"`
+}
+
+type route struct {
+	Route
+	re    *regexp.Regexp
+	proxy http.Handler
+}
+
+// match returns the matched prefix of the path
+func (r *route) match(path string) (prefix string, ok bool) {
+	if r.re == nil {
+		return r.Path, strings.HasPrefix(path, r.Path)
+	}
+	loc := r.re.FindStringIndex(path)
+	if loc == nil {
+		return "", false
+	}
+	if loc[0] != 0 {
+		return "", true
+	}
+	return path[:loc[1]], true
+}
+
+// router forwards the requests to the first matched route in order
+type router []*route
+
+// newRouter returns the router of the routes
+func newRouter(routes []Route) (router, error) {
+	rt := make(router, 0, len(routes))
+	for _, r := range routes {
+		if r.Path == "" && r.Regexp == "" {
+			r.Path = "/"
+		}
+		if r.Path != "" && r.Regexp != "" {
+			return nil, errors.Errorf("route %s: path and regexp are exclusive", r.Target)
+		}
+		if r.Target == "" {
+			return nil, errors.Errorf("route %s%s: target did not specific", r.Path, r.Regexp)
+		}
+		targetURL, err := url.Parse(r.Target)
+		if err != nil {
+			return nil, errors.Wrapf(err, "route target url invalid %s", r.Target)
+		}
+		switch targetURL.Scheme {
+		case "http", "https", "h2c", "grpc":
+		default:
+			return nil, errors.Errorf("route target %s should be http, https, h2c or grpc", r.Target)
+		}
+
+		rr := &route{Route: r}
+		if r.Regexp != "" {
+			if rr.re, err = regexp.Compile(r.Regexp); err != nil {
+				return nil, errors.Wrapf(err, "route regexp invalid %s", r.Regexp)
+			}
+		}
+		proxy := newReverseProxy(targetURL)
+		if r.Host != "" {
+			director := proxy.Director
+			proxy.Director = func(req *http.Request) {
+				director(req)
+				req.Host = r.Host
+			}
+		}
+		rr.proxy = proxy
+		rt = append(rt, rr)
+	}
+	return rt, nil
+}
+
+func (rt router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, route := range rt {
+		prefix, ok := route.match(r.URL.Path)
+		if !ok {
+			continue
+		}
+		if route.StripPrefix && prefix != "" {
+			r = stripPrefix(r, prefix)
+		}
+		route.proxy.ServeHTTP(w, r)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// stripPrefix returns a shallow copy of the request without the prefix of
+// the path, like http.StripPrefix
+func stripPrefix(r *http.Request, prefix string) *http.Request {
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.Path = trimPrefix(r.URL.Path, prefix)
+	if strings.HasPrefix(r.URL.RawPath, prefix) {
+		r2.URL.RawPath = trimPrefix(r.URL.RawPath, prefix)
+	} else {
+		// escaped from Path again
+		r2.URL.RawPath = ""
+	}
+	if p := strings.TrimSuffix(prefix, "/"); p != "" {
+		r2.Header = r.Header.Clone()
+		r2.Header.Set("X-Forwarded-Prefix", p)
+	}
+	return r2
+}
+
+// trimPrefix removes the prefix from the path, which still starts with /
+func trimPrefix(path, prefix string) string {
+	return "/" + strings.TrimPrefix(strings.TrimPrefix(path, prefix), "/")
+}
+
+// newReverseProxy returns the reverse proxy to the target, the h2c:// or
+// grpc:// targets are proxied with h2c, e.g. gRPC services
+func newReverseProxy(targetURL *url.URL) *httputil.ReverseProxy {
+	if targetURL.Scheme == "h2c" || targetURL.Scheme == "grpc" {
+		u := *targetURL
+		u.Scheme = "http"
+		proxy := httputil.NewSingleHostReverseProxy(&u)
+		proxy.Transport = newH2CTargetTransport()
+		// streams the messages as they come
+		proxy.FlushInterval = -1
+		return proxy
+	}
+	return httputil.NewSingleHostReverseProxy(targetURL)
+}
@@ -0,0 +1,85 @@
+package hypro
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_router(t *testing.T) {
+	newTarget := func(name string) string {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s %s %s %s", name, r.URL.EscapedPath(), r.Host, r.Header.Get("X-Forwarded-Prefix"))
+		}))
+		t.Cleanup(ts.Close)
+		return ts.URL
+	}
+	api, v, web := newTarget("api"), newTarget("v"), newTarget("web")
+
+	rt, err := newRouter([]Route{
+		{Path: "/api/", Target: api, StripPrefix: true, Host: "api.internal"},
+		{Regexp: `^/v[0-9]+/`, Target: v, StripPrefix: true},
+		{Regexp: `\.map$`, Target: v},
+		{Target: web},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{"Prefix", "/api/users", "api /users api.internal /api"},
+		{"Prefix only", "/api/", "api / api.internal /api"},
+		{"Prefix escaped", "/api/a%2Fb", "api /a%2Fb api.internal /api"},
+		{"Regexp", "/v2/users", "v /users app.localhost /v2"},
+		{"Regexp not at start", "/js/app.js.map", "v /js/app.js.map app.localhost "},
+		{"In order", "/api", "web /api app.localhost "},
+		{"Fallback", "/", "web / app.localhost "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://app.localhost"+tt.path, nil)
+			w := httptest.NewRecorder()
+			rt.ServeHTTP(w, req)
+			if got, _ := io.ReadAll(w.Body); string(got) != tt.want {
+				t.Errorf("ServeHTTP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("Not found", func(t *testing.T) {
+		rt, _ := newRouter([]Route{{Path: "/api/", Target: api}})
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("ServeHTTP() status = %d, want %d", w.Code, http.StatusNotFound)
+		}
+	})
+}
+
+func Test_newRouter(t *testing.T) {
+	tests := []struct {
+		name    string
+		routes  []Route
+		wantErr bool
+	}{
+		{"Valid", []Route{{Path: "/", Target: "http://localhost:8080"}}, false},
+		{"gRPC", []Route{{Path: "/", Target: "grpc://localhost:50051"}}, false},
+		{"No target", []Route{{Path: "/"}}, true},
+		{"Path and regexp", []Route{{Path: "/", Regexp: "^/", Target: "http://localhost:8080"}}, true},
+		{"Regexp invalid", []Route{{Regexp: "(", Target: "http://localhost:8080"}}, true},
+		{"TCP target", []Route{{Path: "/", Target: "tcp://localhost:5432"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newRouter(tt.routes); (err != nil) != tt.wantErr {
+				t.Errorf("newRouter() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
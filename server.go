@@ -2,18 +2,21 @@ package hypro // import "github.com/chuangbo/hypro"
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	pb "github.com/chuangbo/hypro/protos"
 	"github.com/pkg/errors"
+	"golang.org/x/net/http2"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
@@ -21,10 +24,16 @@ import (
 	"google.golang.org/grpc/status"
 )
 
-const recycleClientDelay = time.Second
+const (
+	recycleClientDelay = time.Second
+
+	// defaultWaitTimeout is how long DialContext waits for the client to
+	// hand in a tunnel when none is idle
+	defaultWaitTimeout = 10 * time.Second
+)
 
 var (
-	errNoIdleConn = errors.New("no idle conn available")
+	errNoIdleConn = errors.New("no tunnel available")
 )
 
 // Server is
@@ -34,23 +43,100 @@ type Server struct {
 
 	CertFile, KeyFile string
 
-	mu    sync.RWMutex // protects users
+	// ClientCAFile enables mutual TLS, the clients must present certificates
+	// signed by it, and could only register the domains in the certificates
+	ClientCAFile string
+
+	// HTTPSAddr serves https if set, terminating tls with the certificate
+	// of HTTPSCertFiles and HTTPSKeyFiles selected by SNI
+	HTTPSAddr                     string
+	HTTPSCertFiles, HTTPSKeyFiles []string
+
+	// ACME obtains the https certificates automatically if set, the http-01
+	// challenges are served on HTTPAddr
+	ACME *ACMEConfig
+
+	// Policy limits the domains the clients could register,
+	// any valid domain is allowed if nil
+	Policy *RegisterPolicy
+
+	// APIKeys are required to register if not empty
+	APIKeys []*APIKey
+
+	// TLSAddr serves the TLS passthrough tunnels if set, the connections
+	// are routed by SNI and the client terminates TLS
+	TLSAddr string
+
+	// TCPHost is the host the TCP and UDP tunnels listen on, all interfaces if empty
+	TCPHost string
+	// TCPPortMin and TCPPortMax are the public ports the TCP and UDP tunnels
+	// could listen on, TCP and UDP tunnels are disabled if not set
+	TCPPortMin, TCPPortMax int
+
+	// UpgradeIdleTimeout closes the upgraded connections, e.g. WebSocket,
+	// without any traffic for it, defaults to 10 minutes
+	UpgradeIdleTimeout time.Duration
+
+	// WaitTimeout bounds how long a request waits for the tunnel of
+	// the requested host, defaults to 10 seconds
+	WaitTimeout time.Duration
+
+	// Logger logs the events of the server, slog.Default() if nil
+	Logger *slog.Logger
+
+	// AccessLog logs the requests of the http and https listeners, if set
+	AccessLog *AccessLog
+
+	mu    sync.RWMutex // protects users and the servers below
 	users map[string]*user
 
+	httpServer  *h2cServer
+	httpsServer *http.Server
+	tlsListener net.Listener
+	grpcServer  *grpc.Server
+	transport   *http.Transport
+	h2c         *http2.Transport
+
 	recycles chan *user
 
-	done chan struct{}
+	// lastConnID is the id of the last tunnel connection
+	lastConnID atomic.Uint64
+
+	// initOnce makes the channels and the users, for ListenAndServe and
+	// Shutdown even if the server is not started
+	initOnce     sync.Once
+	done         chan struct{}
+	shutdownOnce sync.Once
+	// closeTunnels is closed to end the tunnels on shutdown
+	closeTunnels chan struct{}
 
 	pb.UnimplementedTunnelServer
 }
 
 type user struct {
 	host, token string
+	// apiKey is the key registered with, if any
+	apiKey *APIKey
+	// protocol is the traffic of the tunnel, listener accepts the public
+	// connections of a TCP tunnel, and packetConn the datagrams of a UDP tunnel
+	protocol   Protocol
+	listener   net.Listener
+	packetConn net.PacketConn
+	port       int
+	// h2c is whether the client serves h2c
+	h2c bool
 
 	server *Server
 
-	mu        sync.RWMutex // protects idle conns
-	idleConns []net.Conn
+	mu sync.RWMutex // protects the listeners, sessions, waiters and removed
+	// removed is set once the user is replaced, unregistered or recycled,
+	// no tunnel could be added to it any more
+	removed bool
+	// sessions are the multiplexing tunnels, new connections are opened
+	// on the latest one
+	sessions []*muxSession
+	// waiters are the pending DialContext calls, served in FIFO order
+	waiters []chan net.Conn
 
 	createdAt, lastConnAt time.Time
 }
@@ -79,45 +165,153 @@ func (s *Server) ListenAndServe() error {
 		return err
 	}
 
+	// everything which could fail is prepared before listening, so that
+	// nothing is left running on an error
+	grpcServer, err := makeGrpcServer(s.CertFile, s.KeyFile, s.ClientCAFile, grpc.UnaryInterceptor(s.authInterceptor))
+	if err != nil {
+		return errors.Wrap(err, "could not make grpc server")
+	}
+	pb.RegisterTunnelServer(grpcServer, s)
+
+	// http reverse proxy
+	reverseProxy := s.makeReverseProxy()
+	if s.AccessLog != nil {
+		reverseProxy = s.AccessLog.Handler(reverseProxy)
+	}
+	var httpHandler http.Handler = reverseProxy
+
+	var m *acmeManager
+	if s.ACME != nil {
+		if m, err = s.newACMEManager(); err != nil {
+			return errors.Wrap(err, "could not make acme manager")
+		}
+		httpHandler = m.HTTPHandler(reverseProxy)
+	}
+
+	// serves h2c as well for the plaintext gRPC clients
+	httpServer, err := newH2CServer(httpHandler)
+	if err != nil {
+		return errors.Wrap(err, "could not configure h2c")
+	}
+	httpServer.Addr = s.HTTPAddr
+
+	var httpsServer *http.Server
+	if s.HTTPSAddr != "" {
+		store, err := loadCertStore(s.HTTPSCertFiles, s.HTTPSKeyFiles)
+		if err != nil {
+			return errors.Wrap(err, "could not load https certificates")
+		}
+		getCertificate := store.GetCertificate
+		if m != nil {
+			// the certificate files take precedence over acme
+			getCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				if cert := store.match(strings.ToLower(hello.ServerName)); cert != nil {
+					return cert, nil
+				}
+				return m.GetCertificate(hello)
+			}
+		}
+		httpsServer = &http.Server{
+			Addr:      s.HTTPSAddr,
+			Handler:   reverseProxy,
+			TLSConfig: &tls.Config{GetCertificate: getCertificate},
+		}
+	}
+
 	// grpc server
-	log.Printf("Starting grpc server at %v\n", s.GRPCAddr)
+	s.logger().Info("starting grpc server", "addr", s.GRPCAddr)
 	lis, err := net.Listen("tcp", s.GRPCAddr)
 	if err != nil {
 		return errors.Wrapf(err, "failed to listen grpc on %s", s.GRPCAddr)
 	}
 
-	grpcServer, err := makeGrpcServer(s.CertFile, s.KeyFile)
+	// all the addresses are bound before serving any of them
+	listeners := []net.Listener{lis}
+	listen := func(name, addr string) (net.Listener, error) {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, errors.Wrapf(err, "failed to listen %s on %s", name, addr)
+		}
+		listeners = append(listeners, l)
+		return l, nil
+	}
+	var tlsListener net.Listener
+	if s.TLSAddr != "" {
+		s.logger().Info("starting tls passthrough server", "addr", s.TLSAddr)
+		if tlsListener, err = listen("tls", s.TLSAddr); err != nil {
+			return err
+		}
+	}
+	s.logger().Info("starting http server", "addr", s.HTTPAddr)
+	httpListener, err := listen("http", s.HTTPAddr)
 	if err != nil {
-		return errors.Wrap(err, "could not make grpc server")
+		return err
+	}
+	var httpsListener net.Listener
+	if httpsServer != nil {
+		s.logger().Info("starting https server", "addr", s.HTTPSAddr)
+		if httpsListener, err = listen("https", s.HTTPSAddr); err != nil {
+			return err
+		}
 	}
 
-	pb.RegisterTunnelServer(grpcServer, s)
+	s.mu.Lock()
+	s.grpcServer, s.httpServer, s.httpsServer = grpcServer, httpServer, httpsServer
+	s.tlsListener = tlsListener
+	s.mu.Unlock()
+
 	go grpcServer.Serve(lis)
 	// recycle no connection users
 	go s.recycleUsers()
+	if m != nil {
+		go m.keepWildcard(s.done)
+	}
+	if tlsListener != nil {
+		go s.serveTLSPassthrough(tlsListener)
+	}
 
-	// http reverse proxy
-	reverseProxy := s.makeReverseProxy()
-	log.Printf("Starting http server at %v\n", s.HTTPAddr)
-	if err := http.ListenAndServe(s.HTTPAddr, reverseProxy); err != nil {
-		return errors.Wrapf(err, "failed to listen http on %s", s.HTTPAddr)
+	errCh := make(chan error, 2)
+	go func() {
+		if err := httpServer.Serve(httpListener); err != nil && err != http.ErrServerClosed {
+			errCh <- errors.Wrapf(err, "failed to serve http on %s", s.HTTPAddr)
+			return
+		}
+		errCh <- nil
+	}()
+	if httpsServer != nil {
+		go func() {
+			if err := httpsServer.ServeTLS(httpsListener, "", ""); err != nil && err != http.ErrServerClosed {
+				errCh <- errors.Wrapf(err, "failed to serve https on %s", s.HTTPSAddr)
+				return
+			}
+			errCh <- nil
+		}()
+	}
+
+	if err := <-errCh; err != nil {
+		return err
+	}
+	if httpsServer != nil {
+		return <-errCh
 	}
 	return nil
 }
 
+func (s *Server) logger() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return slog.Default()
+}
+
 func (s *Server) initServer() error {
 	if s.HTTPAddr == "" {
 		return errors.New("http addr could not be empty")
 	}
-	if s.users == nil {
-		s.users = map[string]*user{}
-	}
-	if s.recycles == nil {
-		s.recycles = make(chan *user)
-	}
-	if s.done == nil {
-		s.done = make(chan struct{})
-	}
+	s.init()
 	if s.HTTPPort == "" {
 		_, httpPort, err := net.SplitHostPort(s.HTTPAddr)
 		if err != nil {
@@ -128,62 +322,148 @@ func (s *Server) initServer() error {
 	return nil
 }
 
-func makeGrpcServer(certFile, keyFile string) (grpcServer *grpc.Server, err error) {
-	var opt grpc.ServerOption
+func (s *Server) init() {
+	s.initOnce.Do(func() {
+		s.mu.Lock()
+		if s.users == nil {
+			s.users = map[string]*user{}
+		}
+		s.mu.Unlock()
+		s.recycles = make(chan *user)
+		s.done = make(chan struct{})
+		s.closeTunnels = make(chan struct{})
+	})
+}
 
-	if certFile != "" && keyFile != "" {
+func makeGrpcServer(certFile, keyFile, clientCAFile string, opts ...grpc.ServerOption) (grpcServer *grpc.Server, err error) {
+	if clientCAFile != "" {
+		creds, err1 := makeMutualTLSCreds(certFile, keyFile, clientCAFile)
+		if err1 != nil {
+			err = err1
+			return
+		}
+		opts = append(opts, grpc.Creds(creds))
+	} else if certFile != "" && keyFile != "" {
 		creds, err1 := credentials.NewServerTLSFromFile(certFile, keyFile)
 		if err1 != nil {
 			err = errors.Wrap(err1, "certificates invalid")
 			return
 		}
-		opt = grpc.Creds(creds)
+		opts = append(opts, grpc.Creds(creds))
 	}
 
-	if opt != nil {
-		grpcServer = grpc.NewServer(opt)
-	} else {
-		grpcServer = grpc.NewServer()
-	}
+	grpcServer = grpc.NewServer(opts...)
 	return
 }
 
 func (s *Server) makeReverseProxy() http.Handler {
+	// replace http.DefaultTransport DialContext func to dial to virtual conn
+	s.transport = &http.Transport{
+		DialContext:           s.DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	s.h2c = s.makeH2CTransport()
 	return &httputil.ReverseProxy{
 		Director: func(r *http.Request) {
 			r.URL.Scheme = "http"
 			r.URL.Host = r.Host
+			if r.TLS != nil {
+				r.Header.Set("X-Forwarded-Proto", "https")
+			} else {
+				r.Header.Set("X-Forwarded-Proto", "http")
+			}
+			r.Header.Set(receivedHeader, strconv.FormatInt(time.Now().UnixNano(), 10))
 		},
-		// replace http.DefaultTransport DialContext func to dial to virtual conn
-		Transport: &http.Transport{
-			DialContext:           s.DialContext,
-			MaxIdleConns:          100,
-			IdleConnTimeout:       90 * time.Second,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ExpectContinueTimeout: 1 * time.Second,
+		// the upgraded connections live long, keep them out of the pool
+		Transport: &upgradeRoundTripper{
+			transport: &h2cRoundTripper{server: s, transport: s.transport, h2c: s.h2c},
+			upgrade:   s.makeUpgradeTransport(),
 		},
 	}
 }
 
-// Shutdown close the server
-func (s *Server) Shutdown() error {
+// Shutdown gracefully shuts down the server: it tells the connected clients to
+// reconnect elsewhere, waits for the in-flight http requests, ends the tunnels
+// and stops the grpc server, until everything drained or ctx is done
+func (s *Server) Shutdown(ctx context.Context) (err error) {
+	s.shutdownOnce.Do(func() {
+		err = s.shutdown(ctx)
+	})
+	return
+}
+
+func (s *Server) shutdown(ctx context.Context) error {
+	s.logger().Info("shutting down")
+	s.init()
 	close(s.done)
-	return nil
+
+	s.mu.RLock()
+	httpServer, httpsServer, grpcServer, transport, h2cTransport := s.httpServer, s.httpsServer, s.grpcServer, s.transport, s.h2c
+	tlsListener := s.tlsListener
+	users := make([]*user, 0, len(s.users))
+	for _, c := range s.users {
+		users = append(users, c)
+	}
+	s.mu.RUnlock()
+
+	for _, c := range users {
+		c.goAway()
+		c.closeListener()
+	}
+
+	var err error
+	if httpServer != nil {
+		err = httpServer.Shutdown(ctx)
+	}
+	if httpsServer != nil {
+		if err1 := httpsServer.Shutdown(ctx); err == nil {
+			err = err1
+		}
+	}
+	if tlsListener != nil {
+		tlsListener.Close()
+	}
+	if transport != nil {
+		transport.CloseIdleConnections()
+	}
+	if h2cTransport != nil {
+		h2cTransport.CloseIdleConnections()
+	}
+
+	close(s.closeTunnels)
+
+	if grpcServer != nil {
+		stopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			grpcServer.Stop()
+			if err == nil {
+				err = ctx.Err()
+			}
+		}
+	}
+	return err
 }
 
-// DialContext return a pre-connected proxy connection which actually r/w from grpc
+// DialContext return a pre-connected proxy connection which actually r/w from grpc,
+// it waits until the client hands in a new tunnel if none is idle
 func (s *Server) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
 	host, _, err := net.SplitHostPort(addr)
 	if err != nil {
 		return nil, errors.Wrapf(err, "could not get host from %s", addr)
 	}
-	log.Println(network, addr, host)
-	// TODO: wait until client connected
-	c, err := s.getIdleConn(host)
+	c, err := s.getIdleConn(ctx, host, ProtocolHTTP)
 	if err != nil {
 		return nil, errors.Wrapf(err, "tunnel not found %s", host)
 	}
-	log.Printf("dial new virtual connection: %p\n", c)
 	return c, nil
 }
 
@@ -202,16 +482,40 @@ func (s *Server) CheckVersion(ctx context.Context, req *pb.CheckVersionRequest)
 
 // Register the client
 func (s *Server) Register(ctx context.Context, req *pb.RegisterRequest) (*pb.RegisterResponse, error) {
-	log.Println("Registering domain:", req.Domain)
-	fullDomain := req.Domain
+	logger := s.logger().With("host", req.Domain)
+	logger.Debug("registering")
+	domain := strings.ToLower(req.Domain)
+	if domain == "" {
+		var err error
+		if domain, err = s.randomDomain(); err != nil {
+			return nil, err
+		}
+	} else if err := s.Policy.check(domain); err != nil {
+		logger.Warn("domain rejected", "err", err)
+		return nil, err
+	}
 
-	if s.TunnelExists(req.Domain) {
-		log.Println("Register: domain unavailable:", req.Domain)
-		return nil, status.Errorf(codes.AlreadyExists, "domain %s unavailable", req.Domain)
+	if err := s.checkClientCert(ctx, domain); err != nil {
+		logger.Warn("domain rejected", "err", err)
+		return nil, err
 	}
 
-	if s.HTTPPort != "80" {
-		fullDomain = fmt.Sprintf("%s:%s", req.Domain, s.HTTPPort)
+	// the reconnecting client reclaims its domain with the previous token,
+	// or registers it again if it has been recycled
+	if c := s.authenticatedUser(domain, req.Token); c != nil {
+		logger.Info("domain reclaimed")
+		return &pb.RegisterResponse{
+			FullDomain: s.fullDomain(domain, c.protocol, c.port),
+			Token:      req.Token,
+			Domain:     domain,
+			Port:       uint32(c.port),
+		}, nil
+	}
+
+	// fast path, the domain is checked again with the lock held below
+	if s.TunnelExists(domain) {
+		logger.Warn("domain unavailable")
+		return nil, status.Errorf(codes.AlreadyExists, "domain %s unavailable", domain)
 	}
 
 	token, err := generateRandomString(32)
@@ -219,30 +523,165 @@ func (s *Server) Register(ctx context.Context, req *pb.RegisterRequest) (*pb.Reg
 		return nil, status.Errorf(codes.Internal, "could not create token")
 	}
 
+	var l net.Listener
+	port := 0
+	if req.Protocol == pb.Protocol_TCP {
+		if l, err = s.listenTCP(int(req.Port)); err != nil {
+			logger.Warn("port rejected", "port", req.Port, "err", err)
+			return nil, err
+		}
+		port = l.Addr().(*net.TCPAddr).Port
+	}
+	var pc net.PacketConn
+	if req.Protocol == pb.Protocol_UDP {
+		if pc, err = s.listenUDP(int(req.Port)); err != nil {
+			logger.Warn("port rejected", "port", req.Port, "err", err)
+			return nil, err
+		}
+		port = pc.LocalAddr().(*net.UDPAddr).Port
+	}
+	if req.Protocol == pb.Protocol_TLS && s.TLSAddr == "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "tls tunnels are disabled")
+	}
+
+	closePorts := func() {
+		if l != nil {
+			l.Close()
+		}
+		if pc != nil {
+			pc.Close()
+		}
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
+
+	key := apiKeyFromContext(ctx)
+	if key != nil {
+		if err := s.checkAPIKey(key, domain); err != nil {
+			logger.Warn("domain rejected", "err", err)
+			closePorts()
+			return nil, err
+		}
+	}
+
+	// the previous registration is replaced only if it has no tunnel, it is
+	// marked removed at once so that its client could not add one any more
+	old := s.users[domain]
+	if old != nil {
+		old.mu.Lock()
+		if len(old.sessions) > 0 {
+			old.mu.Unlock()
+			closePorts()
+			logger.Warn("domain unavailable")
+			return nil, status.Errorf(codes.AlreadyExists, "domain %s unavailable", domain)
+		}
+		old.removed = true
+		old.mu.Unlock()
+	}
+
 	c := &user{
-		server:    s,
-		token:     token,
-		idleConns: []net.Conn{},
-		createdAt: time.Now(),
+		host:       domain,
+		apiKey:     key,
+		protocol:   req.Protocol,
+		listener:   l,
+		packetConn: pc,
+		port:       port,
+		h2c:        req.H2C,
+		server:     s,
+		token:      token,
+		createdAt:  time.Now(),
+	}
+	if old != nil {
+		go func() {
+			old.releaseWaiters()
+			old.closeListener()
+		}()
+	}
+	s.users[domain] = c
+	s.logger().Info("registered", "host", domain, "protocol", req.Protocol.String(), "port", port, "users", len(s.users))
+
+	if l != nil {
+		go s.serveTCP(c, l)
+	}
+	if pc != nil {
+		go s.serveUDP(c, pc)
 	}
-	s.users[req.Domain] = c
-	log.Println("number of users", len(s.users))
 
 	// remove token if no connection after register
 	time.AfterFunc(recycleClientDelay, func() {
-		s.recycles <- c
+		s.recycle(c)
 	})
 
 	return &pb.RegisterResponse{
-		FullDomain: fullDomain,
+		FullDomain: s.fullDomain(domain, req.Protocol, port),
 		Token:      token,
+		Domain:     domain,
+		Port:       uint32(port),
 	}, nil
 }
 
-// CreateTunnel accept and keep connection between client and server
-// TODO: use metadata or custom auth to bind
+// fullDomain returns the public address of the tunnel
+func (s *Server) fullDomain(domain string, protocol Protocol, port int) string {
+	switch protocol {
+	case ProtocolTCP, ProtocolUDP:
+		return fmt.Sprintf("%s:%d", domain, port)
+	case ProtocolTLS:
+		if _, tlsPort, err := net.SplitHostPort(s.TLSAddr); err == nil && tlsPort != "443" {
+			return fmt.Sprintf("%s:%s", domain, tlsPort)
+		}
+		return domain
+	}
+	if s.HTTPPort != "80" {
+		return fmt.Sprintf("%s:%s", domain, s.HTTPPort)
+	}
+	return domain
+}
+
+// randomDomain returns an unused random domain under the policy suffix
+func (s *Server) randomDomain() (string, error) {
+	for i := 0; i < 3; i++ {
+		domain, err := s.Policy.randomDomain()
+		if err != nil {
+			return "", err
+		}
+		s.mu.RLock()
+		_, exists := s.users[domain]
+		s.mu.RUnlock()
+		if !exists {
+			return domain, nil
+		}
+	}
+	return "", status.Errorf(codes.Internal, "could not assign a domain")
+}
+
+// Unregister releases the domain of the client
+func (s *Server) Unregister(ctx context.Context, req *pb.UnregisterRequest) (*pb.UnregisterResponse, error) {
+	// the user could be recycled at the same time, the token is checked and
+	// the user removed at once
+	s.mu.Lock()
+	c := s.users[req.Domain]
+	if req.Domain == "" || req.Token == "" || c == nil || c.token != req.Token {
+		s.mu.Unlock()
+		return nil, status.Errorf(codes.Unauthenticated, "valid token required")
+	}
+	c.mu.Lock()
+	c.removed = true
+	c.mu.Unlock()
+	delete(s.users, req.Domain)
+	s.logger().Info("unregistered", "host", req.Domain, "users", len(s.users))
+	s.mu.Unlock()
+
+	c.releaseWaiters()
+	c.closeListener()
+
+	return &pb.UnregisterResponse{}, nil
+}
+
+// CreateTunnel accept and keep connection between client and server.
+// The stream is bound to the user by the authorization metadata
+// "Basic host:token", and runs in multiplexing mode as the client sends
+// the muxMetadataKey metadata
 func (s *Server) CreateTunnel(stream pb.Tunnel_CreateTunnelServer) error {
 	md, ok := metadata.FromIncomingContext(stream.Context())
 	if !ok {
@@ -262,91 +701,38 @@ func (s *Server) CreateTunnel(stream pb.Tunnel_CreateTunnelServer) error {
 
 	host, token := parts[0], parts[1]
 
-	if !s.Authenticated(host, token) {
+	c := s.authenticatedUser(host, token)
+	if c == nil {
 		return status.Errorf(codes.Unauthenticated, "valid token required")
 	}
 
-	s.mu.RLock()
-	c := s.users[host]
-	s.mu.RUnlock()
-
-	c.mu.RLock()
-	if len(c.idleConns) >= maxWaitingConnections {
-		c.mu.RUnlock()
-		return status.Errorf(codes.ResourceExhausted, "reached max waiting connections %d", maxWaitingConnections)
+	// the clients since MinClientVersion always multiplex
+	if len(md[muxMetadataKey]) == 0 {
+		return status.Errorf(codes.FailedPrecondition, "multiplexing tunnel required")
 	}
-	c.mu.RUnlock()
 
-	p1, p2 := net.Pipe()
-
-	c.putIdleConn(p2)
-	defer c.removeIdleConn(p2)
-
-	go s.recvLoop(stream, p1)
-	return s.sendLoop(stream, p1)
-}
-
-func (s *Server) recvLoop(stream pb.Tunnel_CreateTunnelServer, p1 io.WriteCloser) {
-	defer log.Println("tunnel closed")
-
-	log.Println("start recv loop")
-	defer log.Println("recv loop stopped")
-	defer p1.Close()
-
-	for {
-		packet, err := stream.Recv()
-		// log.Println("Received", packet, err)
-		if err == io.EOF {
-			log.Println("recv eof")
-			return
-		}
-		if err != nil {
-			log.Println("could not recv from stream:", err)
-			return
-		}
-		log.Println("Received", len(packet.Data))
-		if len(packet.Data) == 0 {
-			continue
-		}
-		// log.Println("writing", packet.Data)
-		nw, err := p1.Write(packet.Data)
-		if err != nil {
-			log.Println("could not write to pipe:", err)
-			return
-		}
-		if nw != len(packet.Data) {
-			// TODO: close with error
-			log.Println("could not write all to pipe:", io.ErrShortWrite)
-			return
-		}
+	logger := c.logger().With("conn_id", s.lastConnID.Add(1))
+	session := newMuxSession(stream, nil)
+	session.logger = logger
+	if c.protocol == ProtocolUDP {
+		session.onDatagram = c.writeDatagram
 	}
-}
-
-func (s *Server) sendLoop(stream pb.Tunnel_CreateTunnelServer, p1 io.Reader) error {
-	log.Println("start send loop")
-	defer log.Println("send loop stopped")
-
-	buf := make([]byte, 32*1024)
+	if !c.addSession(session) {
+		return status.Errorf(codes.Unauthenticated, "valid token required")
+	}
+	defer c.removeSession(session)
+	logger.Info("tunnel opened")
+	defer logger.Info("tunnel closed")
 
-	for {
-		nr, err := p1.Read(buf)
-		if nr > 0 {
-			packet := &pb.Packet{Data: buf[0:nr]}
-			err := stream.Send(packet)
-			if err == io.EOF {
-				return nil
-			}
-			if err != nil {
-				return errors.Wrap(err, "could not send to stream")
-			}
-		}
-		if err == io.EOF {
-			return nil
-		}
-		if err != nil {
-			log.Println("could not read from pipe:", err)
-			return nil
-		}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- session.serve()
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-s.closeTunnels:
+		return nil
 	}
 }
 
@@ -360,81 +746,216 @@ func (s *Server) TunnelExists(host string) bool {
 	}
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	return len(c.idleConns) > 0
+	return len(c.sessions) > 0
 }
 
 // Authenticated checks valid token from grpc metadata
 func (s *Server) Authenticated(host, token string) bool {
+	return s.authenticatedUser(host, token) != nil
+}
+
+// authenticatedUser returns the user of the host if the token is valid, or nil
+func (s *Server) authenticatedUser(host, token string) *user {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return host != "" && token != "" && s.users[host] != nil && s.users[host].token == token
+	c := s.users[host]
+	if host == "" || token == "" || c == nil || c.token != token {
+		return nil
+	}
+	return c
 }
 
-func (s *Server) getIdleConn(host string) (net.Conn, error) {
+// getIdleConn returns a conn to the client of the host, which must be
+// registered with the protocol
+func (s *Server) getIdleConn(ctx context.Context, host string, protocol Protocol) (net.Conn, error) {
 	s.mu.RLock()
-	c, ok := s.users[host]
+	c, ok := s.users[strings.ToLower(host)]
 	s.mu.RUnlock()
 
-	if ok {
-		return c.getIdleConn()
+	if !ok || c.protocol != protocol {
+		return nil, errNoIdleConn
 	}
-	return nil, errNoIdleConn
+
+	ctx, cancel := context.WithTimeout(ctx, s.waitTimeout())
+	defer cancel()
+	return c.getIdleConn(ctx)
+}
+
+func (s *Server) waitTimeout() time.Duration {
+	if s.WaitTimeout > 0 {
+		return s.WaitTimeout
+	}
+	return defaultWaitTimeout
 }
 
-func (c *user) getIdleConn() (net.Conn, error) {
+// getIdleConn opens a conn on the multiplexing tunnel, or queues up and waits
+// until the client creates a tunnel or the ctx is done
+func (c *user) getIdleConn(ctx context.Context) (net.Conn, error) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
-	if len(c.idleConns) > 0 {
-		conn := c.idleConns[0]
-		c.idleConns = c.idleConns[1:]
-		log.Println("number of idle conns:", len(c.idleConns))
+	if c.removed {
+		c.mu.Unlock()
+		return nil, errNoIdleConn
+	}
+	if session := c.activeSession(); session != nil {
+		c.mu.Unlock()
+		return session.open()
+	}
+	w := make(chan net.Conn, 1)
+	c.waiters = append(c.waiters, w)
+	c.logger().Debug("waiting for tunnel", "waiters", len(c.waiters))
+	c.mu.Unlock()
+
+	select {
+	case conn := <-w:
+		if conn == nil {
+			return nil, errNoIdleConn
+		}
 		return conn, nil
+	case <-ctx.Done():
+		c.mu.Lock()
+		removed := c.removeWaiter(w)
+		c.mu.Unlock()
+		if !removed {
+			// a conn was opened while giving up
+			if conn := <-w; conn != nil {
+				conn.Close()
+			}
+		}
+		return nil, errors.Wrap(ctx.Err(), errNoIdleConn.Error())
+	}
+}
+
+// logger returns the logger of the server with the host
+func (c *user) logger() *slog.Logger {
+	logger := slog.Default()
+	if c.server != nil {
+		logger = c.server.logger()
+	}
+	return logger.With("host", c.host)
+}
+
+// activeSession returns the latest multiplexing tunnel which is not going away.
+// c.mu must be held
+func (c *user) activeSession() *muxSession {
+	for i := len(c.sessions) - 1; i >= 0; i-- {
+		if !c.sessions[i].goingAway() {
+			return c.sessions[i]
+		}
 	}
-	return nil, errNoIdleConn
+	return nil
 }
 
-func (c *user) putIdleConn(conn net.Conn) {
+// addSession adds the multiplexing tunnel and serves all the waiters on it,
+// it reports false if the user has been removed
+func (c *user) addSession(session *muxSession) bool {
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	if c.removed {
+		c.mu.Unlock()
+		return false
+	}
 	c.lastConnAt = time.Now()
-	c.idleConns = append(c.idleConns, conn)
-	log.Println("number of idle conns:", len(c.idleConns), c.host)
+	c.sessions = append(c.sessions, session)
+	waiters := c.waiters
+	c.waiters = nil
+	c.mu.Unlock()
+
+	for _, w := range waiters {
+		conn, err := session.open()
+		if err != nil {
+			c.logger().Error("could not open stream for waiter", "err", err)
+		}
+		w <- conn
+	}
+	return true
 }
 
-// removeIdleConn removes the closed conn from the pool
-func (c *user) removeIdleConn(conn net.Conn) {
+// removeSession removes the closed multiplexing tunnel
+func (c *user) removeSession(session *muxSession) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	conns := c.idleConns
-	for i, v := range conns {
-		if v == conn {
-			conns = append(conns[:i], conns[i+1:]...)
-			c.idleConns = conns
+	for i, v := range c.sessions {
+		if v == session {
+			c.sessions = append(c.sessions[:i], c.sessions[i+1:]...)
 			break
 		}
 	}
-	if len(conns) == 0 {
+	if len(c.sessions) == 0 {
 		time.AfterFunc(recycleClientDelay, func() {
-			c.server.recycles <- c
+			c.server.recycle(c)
 		})
 	}
-	log.Println("number of idle conns:", len(conns), c.host)
+}
+
+// goAway tells the clients not to open connections on the tunnels any more
+func (c *user) goAway() {
+	c.mu.RLock()
+	sessions := append([]*muxSession(nil), c.sessions...)
+	c.mu.RUnlock()
+
+	for _, session := range sessions {
+		if err := session.sendGoAway(); err != nil {
+			c.logger().Warn("could not send goaway", "err", err)
+		}
+	}
+}
+
+// releaseWaiters marks the user removed and fails all the waiters
+func (c *user) releaseWaiters() {
+	c.mu.Lock()
+	c.removed = true
+	waiters := c.waiters
+	c.waiters = nil
+	c.mu.Unlock()
+
+	for _, w := range waiters {
+		w <- nil
+	}
+}
+
+// removeWaiter removes w from the queue, reports false if it was already served.
+// c.mu must be held
+func (c *user) removeWaiter(w chan net.Conn) bool {
+	for i, v := range c.waiters {
+		if v == w {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// recycle queues c to be checked by recycleUsers, or drops it once the
+// server is shut down
+func (s *Server) recycle(c *user) {
+	select {
+	case s.recycles <- c:
+	case <-s.done:
+	}
 }
 
 func (s *Server) recycleUsers() {
 	for {
 		select {
 		case c := <-s.recycles:
-			c.mu.RLock()
-			// the token should be recycle if the client has no idle connections,
-			// and the last connection was created before 1 second ago
-			if len(c.idleConns) == 0 &&
-				c.lastConnAt.Before(time.Now().Add(-recycleClientDelay)) {
-				s.mu.Lock()
-				delete(s.users, c.host)
-				s.mu.Unlock()
+			// s.mu is held before c.mu as in Register
+			s.mu.Lock()
+			c.mu.Lock()
+			// the token should be recycle if the client has no tunnels,
+			// and the last tunnel was created before 1 second ago
+			recycled := len(c.sessions) == 0 &&
+				c.lastConnAt.Before(time.Now().Add(-recycleClientDelay))
+			if recycled {
+				c.removed = true
+				if s.users[c.host] == c {
+					delete(s.users, c.host)
+				}
+			}
+			c.mu.Unlock()
+			s.mu.Unlock()
+			if recycled {
+				c.releaseWaiters()
+				c.closeListener()
 			}
-			c.mu.RUnlock()
 		case <-s.done:
 			return
 		}
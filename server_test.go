@@ -0,0 +1,294 @@
+package hypro
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	pb "github.com/chuangbo/hypro/protos"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newTestServer returns an initialized server which is not listening
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	s := &Server{HTTPAddr: "127.0.0.1:80"}
+	if err := s.initServer(); err != nil {
+		t.Fatal(err)
+	}
+	go s.recycleUsers()
+	t.Cleanup(func() { close(s.done) })
+	return s
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	tests := []struct {
+		name string
+		s    *Server
+	}{
+		{"Not started", &Server{}},
+		{"Failed to start", &Server{HTTPAddr: "127.0.0.1:80", GRPCAddr: "invalid"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.s.GRPCAddr != "" {
+				if err := tt.s.ListenAndServe(); err == nil {
+					t.Fatal("ListenAndServe() error = nil")
+				}
+			}
+			if err := tt.s.Shutdown(context.Background()); err != nil {
+				t.Errorf("Shutdown() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestServer_ListenAndServe_error(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	tests := []struct {
+		name      string
+		configure func(s *Server)
+	}{
+		{"Invalid https cert", func(s *Server) {
+			s.HTTPSAddr = fmt.Sprintf("127.0.0.1:%d", freePort(t))
+			s.HTTPSCertFiles, s.HTTPSKeyFiles = []string{"missing.crt"}, []string{"missing.key"}
+		}},
+		{"TLS in use", func(s *Server) {
+			s.TLSAddr = busy.Addr().String()
+		}},
+		{"HTTP in use", func(s *Server) {
+			s.TLSAddr = fmt.Sprintf("127.0.0.1:%d", freePort(t))
+			s.HTTPAddr = busy.Addr().String()
+		}},
+		{"HTTPS in use", func(s *Server) {
+			s.TLSAddr = fmt.Sprintf("127.0.0.1:%d", freePort(t))
+			s.HTTPSAddr = busy.Addr().String()
+			certFile, keyFile := writeTestCert(t, newSignedTestCert(t, nil, "localhost", "localhost"))
+			s.HTTPSCertFiles, s.HTTPSKeyFiles = []string{certFile}, []string{keyFile}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{
+				GRPCAddr: fmt.Sprintf("127.0.0.1:%d", freePort(t)),
+				HTTPAddr: fmt.Sprintf("127.0.0.1:%d", freePort(t)),
+			}
+			tt.configure(s)
+			if err := s.ListenAndServe(); err == nil {
+				t.Fatal("ListenAndServe() error = nil")
+			}
+			// none of the listeners is left open
+			for _, addr := range []string{s.GRPCAddr, s.TLSAddr, s.HTTPAddr, s.HTTPSAddr} {
+				if addr == "" || addr == busy.Addr().String() {
+					continue
+				}
+				l, err := net.Listen("tcp", addr)
+				if err != nil {
+					t.Fatalf("%s is still in use: %v", addr, err)
+				}
+				l.Close()
+			}
+		})
+	}
+}
+
+func TestServer_Register_reclaim(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	r, err := s.Register(ctx, &pb.RegisterRequest{Domain: "app.localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Reclaimed", func(t *testing.T) {
+		got, err := s.Register(ctx, &pb.RegisterRequest{Domain: "app.localhost", Token: r.Token})
+		if err != nil || got.Token != r.Token || got.FullDomain != "app.localhost" {
+			t.Errorf("Register() = %v, %v, want token %s", got, err, r.Token)
+		}
+	})
+
+	t.Run("Recycled", func(t *testing.T) {
+		s.mu.Lock()
+		delete(s.users, "app.localhost")
+		s.mu.Unlock()
+		got, err := s.Register(ctx, &pb.RegisterRequest{Domain: "app.localhost", Token: r.Token})
+		if err != nil || got.Token == "" || got.Token == r.Token {
+			t.Errorf("Register() = %v, %v, want a new token", got, err)
+		}
+	})
+}
+
+func TestServer_Register_replace(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	if _, err := s.Register(ctx, &pb.RegisterRequest{Domain: "app.localhost"}); err != nil {
+		t.Fatal(err)
+	}
+	s.mu.RLock()
+	old := s.users["app.localhost"]
+	s.mu.RUnlock()
+
+	t.Run("Live tunnel", func(t *testing.T) {
+		a, _, accepts := newSessionPair(t)
+		go drainConns(accepts)
+		old.addSession(a)
+		_, err := s.Register(ctx, &pb.RegisterRequest{Domain: "app.localhost"})
+		if got := status.Code(err); got != codes.AlreadyExists {
+			t.Errorf("Register() error = %v, want %v", err, codes.AlreadyExists)
+		}
+		old.removeSession(a)
+	})
+
+	t.Run("Replaced", func(t *testing.T) {
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := old.getIdleConn(ctx)
+			errCh <- err
+		}()
+		waitForWaiters(t, old, 1)
+		if _, err := s.Register(ctx, &pb.RegisterRequest{Domain: "app.localhost"}); err != nil {
+			t.Fatalf("Register() error = %v", err)
+		}
+		select {
+		case err := <-errCh:
+			if err == nil {
+				t.Error("getIdleConn() error = nil, want the waiter failed")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("the waiter of the replaced user is not released")
+		}
+		a, _, _ := newSessionPair(t)
+		if old.addSession(a) {
+			t.Error("addSession() = true on the replaced user")
+		}
+	})
+}
+
+func TestServer_Unregister(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	r, err := s.Register(ctx, &pb.RegisterRequest{Domain: "app.localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		domain   string
+		token    string
+		wantCode codes.Code
+	}{
+		{"WrongToken", "app.localhost", "wrong", codes.Unauthenticated},
+		{"NoToken", "app.localhost", "", codes.Unauthenticated},
+		{"Unregistered", "other.localhost", r.Token, codes.Unauthenticated},
+		{"OK", "app.localhost", r.Token, codes.OK},
+		{"Gone", "app.localhost", r.Token, codes.Unauthenticated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.Unregister(ctx, &pb.UnregisterRequest{Domain: tt.domain, Token: tt.token})
+			if got := status.Code(err); got != tt.wantCode {
+				t.Errorf("Unregister() error = %v, want %v", err, tt.wantCode)
+			}
+		})
+	}
+	if s.Authenticated("app.localhost", r.Token) {
+		t.Error("app.localhost is still registered")
+	}
+}
+
+func TestServer_recycle_shutdown(t *testing.T) {
+	s := &Server{HTTPAddr: "127.0.0.1:80"}
+	if err := s.initServer(); err != nil {
+		t.Fatal(err)
+	}
+	close(s.done)
+	done := make(chan struct{})
+	go func() {
+		s.recycle(&user{server: s})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("recycle() blocks after shutdown")
+	}
+}
+
+func Test_user_getIdleConn(t *testing.T) {
+	t.Run("Session", func(t *testing.T) {
+		a, _, accepts := newSessionPair(t)
+		go drainConns(accepts)
+		c := &user{}
+		c.addSession(a)
+		got, err := c.getIdleConn(context.Background())
+		if err != nil {
+			t.Fatalf("getIdleConn() error = %v", err)
+		}
+		if conn, ok := got.(*muxConn); !ok || conn.session != a {
+			t.Errorf("getIdleConn() = %v, want a conn of the session", got)
+		}
+	})
+
+	t.Run("Waiters served by the new session", func(t *testing.T) {
+		c := &user{}
+		results := make([]chan net.Conn, 3)
+		for i := range results {
+			results[i] = make(chan net.Conn, 1)
+			go func(ch chan net.Conn) {
+				conn, _ := c.getIdleConn(context.Background())
+				ch <- conn
+			}(results[i])
+			waitForWaiters(t, c, i+1)
+		}
+		a, _, accepts := newSessionPair(t)
+		go drainConns(accepts)
+		c.addSession(a)
+		for i := range results {
+			if conn, ok := (<-results[i]).(*muxConn); !ok || conn.session != a {
+				t.Errorf("waiter %d got %v, want a conn of the session", i, conn)
+			}
+		}
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		c := &user{}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if _, err := c.getIdleConn(ctx); err == nil {
+			t.Error("getIdleConn() error = nil, want timeout")
+		}
+		if len(c.waiters) != 0 {
+			t.Errorf("waiters = %d, want 0", len(c.waiters))
+		}
+	})
+}
+
+// drainConns closes the accepted conns
+func drainConns(accepts <-chan net.Conn) {
+	for conn := range accepts {
+		conn.Close()
+	}
+}
+
+func waitForWaiters(t *testing.T, c *user, n int) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		c.mu.RLock()
+		got := len(c.waiters)
+		c.mu.RUnlock()
+		if got == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("waiters did not reach %d", n)
+}
@@ -0,0 +1,211 @@
+package hypro
+
+import (
+	"compress/gzip"
+	"crypto/subtle"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// FileServer serves the files of Dir, the range requests are served by
+// http.FileServer
+type FileServer struct {
+	Dir string
+
+	// Listing lists the files of the directories without index.html
+	Listing bool
+
+	// SPA serves /index.html for the paths not found, so that a single page
+	// app routes them
+	SPA bool
+
+	// Dotfiles serves the files and directories starting with ".", e.g.
+	// .well-known, they are not found and not listed otherwise so that
+	// .env or .git are not exposed
+	Dotfiles bool
+
+	// Username and Password are required with basic auth if Username is set
+	Username, Password string
+}
+
+func (s *FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.Username != "" && !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="hypro"`)
+		http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") &&
+		r.Method != http.MethodHead && r.Header.Get("Range") == "" {
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.Close()
+		w = gw
+	}
+
+	name := path.Clean("/" + r.URL.Path)
+	var dir http.FileSystem = http.Dir(s.Dir)
+	if !s.Dotfiles {
+		if hasDotSegment(name) {
+			http.NotFound(w, r)
+			return
+		}
+		dir = noDotFileSystem{dir}
+	}
+	if !s.exists(dir, name) {
+		if s.SPA && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+			s.serveIndex(w, r, dir)
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+	http.FileServer(dir).ServeHTTP(w, r)
+}
+
+// authorized reports whether the request has the basic auth credentials
+func (s *FileServer) authorized(r *http.Request) bool {
+	username, password, ok := r.BasicAuth()
+	return ok &&
+		subtle.ConstantTimeCompare([]byte(username), []byte(s.Username)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(password), []byte(s.Password)) == 1
+}
+
+// exists reports whether the file exists, the directories exist only if they
+// have index.html or Listing is enabled
+func (s *FileServer) exists(dir http.FileSystem, name string) bool {
+	f, err := dir.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	if !fi.IsDir() || s.Listing {
+		return true
+	}
+	index, err := dir.Open(path.Join(name, "index.html"))
+	if err != nil {
+		return false
+	}
+	index.Close()
+	return true
+}
+
+// serveIndex serves /index.html as is, http.FileServer redirects it to /
+func (s *FileServer) serveIndex(w http.ResponseWriter, r *http.Request, dir http.FileSystem) {
+	f, err := dir.Open("/index.html")
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+}
+
+// hasDotSegment reports whether any segment of the path starts with "."
+func hasDotSegment(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// noDotFileSystem hides the files and directories starting with "."
+type noDotFileSystem struct {
+	http.FileSystem
+}
+
+func (fsys noDotFileSystem) Open(name string) (http.File, error) {
+	if hasDotSegment(name) {
+		return nil, fs.ErrNotExist
+	}
+	f, err := fsys.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return noDotFile{f}, nil
+}
+
+// noDotFile leaves the dotfiles out of the directory listing
+type noDotFile struct {
+	http.File
+}
+
+func (f noDotFile) Readdir(n int) ([]fs.FileInfo, error) {
+	files, err := f.File.Readdir(n)
+	list := files[:0]
+	for _, fi := range files {
+		if !strings.HasPrefix(fi.Name(), ".") {
+			list = append(list, fi)
+		}
+	}
+	return list, err
+}
+
+// gzipResponseWriter compresses the text responses
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	h := w.Header()
+	h.Add("Vary", "Accept-Encoding")
+	if code == http.StatusOK && h.Get("Content-Encoding") == "" && isText(h.Get("Content-Type")) {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", "gzip")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Close flushes the compressed response
+func (w *gzipResponseWriter) Close() error {
+	if w.gz == nil {
+		return nil
+	}
+	return w.gz.Close()
+}
+
+// isText reports whether the content type is worth compressing
+func isText(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "text/") {
+		return true
+	}
+	switch mediaType {
+	case "application/javascript", "application/json", "application/xml",
+		"application/wasm", "image/svg+xml", "application/manifest+json":
+		return true
+	}
+	return false
+}
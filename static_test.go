@@ -0,0 +1,125 @@
+package hypro
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileServer_ServeHTTP(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"index.html":       "<html>index</html>",
+		"app.js":           strings.Repeat("console.log(1);", 100),
+		"logo.png":         "\x89PNG",
+		"docs/index.html":  "<html>docs</html>",
+		"assets/style.css": "body{}",
+		".env":             "SECRET=1",
+		".git/config":      "[core]",
+		"assets/.hidden":   "hidden",
+		".well-known/x":    "well known",
+	}
+	for name, content := range files {
+		os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755)
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	type want struct {
+		code     int
+		body     string
+		encoding string
+	}
+	tests := []struct {
+		name   string
+		s      FileServer
+		path   string
+		header map[string]string
+		want   want
+	}{
+		{"Index", FileServer{}, "/", nil, want{200, files["index.html"], ""}},
+		{"File", FileServer{}, "/logo.png", nil, want{200, files["logo.png"], ""}},
+		{"Directory index", FileServer{}, "/docs/", nil, want{200, files["docs/index.html"], ""}},
+		{"Listing disabled", FileServer{}, "/assets/", nil, want{404, "", ""}},
+		{"Listing", FileServer{Listing: true}, "/assets/", nil, want{200, "style.css", ""}},
+		{"Not found", FileServer{}, "/about", nil, want{404, "", ""}},
+		{"SPA fallback", FileServer{SPA: true}, "/about/team", nil, want{200, files["index.html"], ""}},
+		{"SPA file", FileServer{SPA: true}, "/app.js", nil, want{200, files["app.js"], ""}},
+		{"Range", FileServer{}, "/app.js", map[string]string{"Range": "bytes=0-6"}, want{206, "console", ""}},
+		{"Gzip text", FileServer{}, "/app.js", map[string]string{"Accept-Encoding": "gzip"}, want{200, files["app.js"], "gzip"}},
+		{"Gzip binary", FileServer{}, "/logo.png", map[string]string{"Accept-Encoding": "gzip"}, want{200, files["logo.png"], ""}},
+		{"Gzip range", FileServer{}, "/app.js", map[string]string{"Accept-Encoding": "gzip", "Range": "bytes=0-6"}, want{206, "console", ""}},
+		{"Unauthorized", FileServer{Username: "u", Password: "p"}, "/", nil, want{401, "", ""}},
+		{"Authorized", FileServer{Username: "u", Password: "p"}, "/", map[string]string{"Authorization": "Basic dTpw"}, want{200, files["index.html"], ""}},
+		{"Wrong password", FileServer{Username: "u", Password: "p"}, "/", map[string]string{"Authorization": "Basic dTp4"}, want{401, "", ""}},
+		{"Dotfile", FileServer{}, "/.env", nil, want{404, "", ""}},
+		{"Dot directory", FileServer{}, "/.git/config", nil, want{404, "", ""}},
+		{"Dotfile SPA", FileServer{SPA: true}, "/.env", nil, want{404, "", ""}},
+		{"Dotfile escaped", FileServer{}, "/%2eenv", nil, want{404, "", ""}},
+		{"Dotfile listing", FileServer{Listing: true}, "/assets/", nil, want{200, "style.css", ""}},
+		{"Dotfiles allowed", FileServer{Dotfiles: true}, "/.well-known/x", nil, want{200, files[".well-known/x"], ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.s.Dir = dir
+			req := httptest.NewRequest("GET", tt.path, nil)
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			tt.s.ServeHTTP(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != tt.want.code {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.want.code)
+			}
+			if got := resp.Header.Get("Content-Encoding"); got != tt.want.encoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, tt.want.encoding)
+			}
+			if tt.want.body == "" {
+				return
+			}
+			var body io.Reader = resp.Body
+			if tt.want.encoding == "gzip" {
+				gz, err := gzip.NewReader(resp.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = gz
+			}
+			b, _ := io.ReadAll(body)
+			if !strings.Contains(string(b), tt.want.body) {
+				t.Errorf("body = %q, want %q", b, tt.want.body)
+			}
+			if strings.Contains(string(b), ".hidden") {
+				t.Errorf("body = %q, want no dotfiles", b)
+			}
+		})
+	}
+}
+
+func Test_isText(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"text/html; charset=utf-8", true},
+		{"text/javascript; charset=utf-8", true},
+		{"application/json", true},
+		{"image/svg+xml", true},
+		{"image/png", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			if got := isText(tt.contentType); got != tt.want {
+				t.Errorf("isText() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
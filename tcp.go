@@ -0,0 +1,234 @@
+package hypro
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+
+	pb "github.com/chuangbo/hypro/protos"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Protocol is the traffic carried by a tunnel
+type Protocol = pb.Protocol
+
+const (
+	// ProtocolHTTP tunnels are routed by the Host header on the http listeners
+	ProtocolHTTP = pb.Protocol_HTTP
+	// ProtocolTCP tunnels accept raw TCP on a public port of the server
+	ProtocolTCP = pb.Protocol_TCP
+	// ProtocolTLS tunnels accept TLS routed by SNI, terminated by the client
+	ProtocolTLS = pb.Protocol_TLS
+	// ProtocolUDP tunnels accept datagrams on a public port of the server
+	ProtocolUDP = pb.Protocol_UDP
+)
+
+// listenTCP listens on the requested port, or a free port in the range if zero
+func (s *Server) listenTCP(port int) (net.Listener, error) {
+	var l net.Listener
+	err := s.listenPort("tcp", port, func(addr string) (err error) {
+		l, err = net.Listen("tcp", addr)
+		return
+	})
+	return l, err
+}
+
+// listenPort calls listen with the address of the requested port, or of
+// the free ports in the range in turn if zero, until it succeeds
+func (s *Server) listenPort(network string, port int, listen func(addr string) error) error {
+	if s.TCPPortMin <= 0 || s.TCPPortMax < s.TCPPortMin {
+		return status.Errorf(codes.FailedPrecondition, "%s tunnels are disabled", network)
+	}
+	if port != 0 {
+		if port < s.TCPPortMin || port > s.TCPPortMax {
+			return status.Errorf(codes.InvalidArgument, "port %d out of range %d-%d", port, s.TCPPortMin, s.TCPPortMax)
+		}
+		if err := listen(net.JoinHostPort(s.TCPHost, strconv.Itoa(port))); err != nil {
+			return status.Errorf(codes.AlreadyExists, "port %d unavailable", port)
+		}
+		return nil
+	}
+
+	// start from a random port so the released ports are not reused right away
+	n := s.TCPPortMax - s.TCPPortMin + 1
+	start := rand.Intn(n)
+	for i := 0; i < n; i++ {
+		port := s.TCPPortMin + (start+i)%n
+		if err := listen(net.JoinHostPort(s.TCPHost, strconv.Itoa(port))); err == nil {
+			return nil
+		}
+	}
+	return status.Errorf(codes.ResourceExhausted, "no port available in range %d-%d", s.TCPPortMin, s.TCPPortMax)
+}
+
+// serveTCP accepts the public connections of the tcp tunnel and pipes each
+// of them through a new connection to the client, until l is closed
+func (s *Server) serveTCP(c *user, l net.Listener) {
+	logger := c.logger().With("addr", l.Addr())
+	logger.Info("tcp tunnel started")
+	defer logger.Info("tcp tunnel closed")
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), s.waitTimeout())
+			tunnel, err := c.getIdleConn(ctx)
+			cancel()
+			if err != nil {
+				logger.Warn("could not open tunnel connection", "remote_addr", conn.RemoteAddr(), "err", err)
+				conn.Close()
+				return
+			}
+			pipe(conn, tunnel)
+		}()
+	}
+}
+
+// closeListener stops accepting the public connections of a tcp tunnel,
+// or the datagrams of a udp tunnel
+func (c *user) closeListener() {
+	c.mu.Lock()
+	l, pc := c.listener, c.packetConn
+	c.listener, c.packetConn = nil, nil
+	c.mu.Unlock()
+	if l != nil {
+		l.Close()
+	}
+	if pc != nil {
+		pc.Close()
+	}
+}
+
+// closeWriter is a conn which could close its write side only,
+// e.g. *net.TCPConn
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// pipe copies between a and b until both sides are done, then closes both.
+// The EOF of one side closes the write side of the other, so a half-closed
+// connection still gets the response, while an error closes both right away
+func pipe(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	copyConn := func(dst, src net.Conn) {
+		defer func() { done <- struct{}{} }()
+		if _, err := io.Copy(dst, src); err == nil {
+			if cw, ok := dst.(closeWriter); ok && cw.CloseWrite() == nil {
+				return
+			}
+		}
+		a.Close()
+		b.Close()
+	}
+	go copyConn(a, b)
+	go copyConn(b, a)
+	<-done
+	<-done
+	a.Close()
+	b.Close()
+}
+
+// tcpForwarder serves the tunnel connections of the client by piping them
+// to the target, it works like http.Server for Client.DialAndServe
+type tcpForwarder struct {
+	target string
+	logger *slog.Logger
+
+	// workers limits the connections served at once if not nil, the others
+	// wait after they are accepted, so that the tunnel keeps dispatching
+	// the frames of the served ones
+	workers chan struct{}
+	done    chan struct{}
+
+	mu       sync.Mutex // protects listener and closed
+	listener net.Listener
+	closed   bool
+	conns    sync.WaitGroup
+}
+
+// newTCPForwarder returns the forwarder to the target serving at most
+// workers connections at once, unlimited if 0
+func newTCPForwarder(target string, workers int) *tcpForwarder {
+	f := &tcpForwarder{
+		target: target,
+		logger: slog.Default(),
+		done:   make(chan struct{}),
+	}
+	if workers > 0 {
+		f.workers = make(chan struct{}, workers)
+	}
+	return f
+}
+
+// Serve dials the target for every accepted connection
+func (f *tcpForwarder) Serve(l net.Listener) error {
+	f.mu.Lock()
+	f.listener = l
+	f.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			f.mu.Lock()
+			closed := f.closed
+			f.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		f.conns.Add(1)
+		go func() {
+			defer f.conns.Done()
+			if f.workers != nil {
+				select {
+				case f.workers <- struct{}{}:
+				case <-f.done:
+					conn.Close()
+					return
+				}
+				defer func() { <-f.workers }()
+			}
+			target, err := net.Dial("tcp", f.target)
+			if err != nil {
+				f.logger.Error("could not dial target", "target", f.target, "err", err)
+				conn.Close()
+				return
+			}
+			pipe(conn, target)
+		}()
+	}
+}
+
+// Shutdown closes the listener and waits for the connections until ctx is done
+func (f *tcpForwarder) Shutdown(ctx context.Context) error {
+	f.mu.Lock()
+	if !f.closed {
+		f.closed = true
+		close(f.done)
+	}
+	l := f.listener
+	f.mu.Unlock()
+	if l != nil {
+		l.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		f.conns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
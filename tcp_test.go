@@ -0,0 +1,235 @@
+package hypro
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// freePort returns a port which is free to listen on
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestServer_listenTCP(t *testing.T) {
+	port := freePort(t)
+	s := &Server{TCPHost: "127.0.0.1", TCPPortMin: port, TCPPortMax: port}
+
+	tests := []struct {
+		name     string
+		server   *Server
+		port     int
+		wantCode codes.Code
+	}{
+		{"Disabled", &Server{}, 0, codes.FailedPrecondition},
+		{"Requested", s, port, codes.OK},
+		{"Assigned", s, 0, codes.OK},
+		{"Out of range", s, port + 1, codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := tt.server.listenTCP(tt.port)
+			if got := status.Code(err); got != tt.wantCode {
+				t.Fatalf("listenTCP() error = %v, want %v", err, tt.wantCode)
+			}
+			if err != nil {
+				return
+			}
+			defer l.Close()
+			if got := l.Addr().(*net.TCPAddr).Port; got != port {
+				t.Errorf("listenTCP() port = %d, want %d", got, port)
+			}
+		})
+	}
+
+	t.Run("Unavailable", func(t *testing.T) {
+		l, err := s.listenTCP(port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		if _, err := s.listenTCP(port); status.Code(err) != codes.AlreadyExists {
+			t.Errorf("listenTCP() error = %v, want %v", err, codes.AlreadyExists)
+		}
+		if _, err := s.listenTCP(0); status.Code(err) != codes.ResourceExhausted {
+			t.Errorf("listenTCP() error = %v, want %v", err, codes.ResourceExhausted)
+		}
+	})
+}
+
+func TestServer_serveTCP(t *testing.T) {
+	a, _, accepts := newSessionPair(t)
+	s := &Server{}
+	c := &user{host: "db.example.com", server: s, sessions: []*muxSession{a}}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.listener = l
+	go s.serveTCP(c, l)
+	defer c.closeListener()
+
+	// the client side echoes
+	go func() {
+		for peer := range accepts {
+			go io.Copy(peer, peer)
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+		got := make([]byte, 4)
+		if _, err := io.ReadFull(conn, got); err != nil || string(got) != "ping" {
+			t.Errorf("Read() = %q, %v, want ping", got, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestServer_serveTCP_halfClose(t *testing.T) {
+	a, _, accepts := newSessionPair(t)
+	s := &Server{}
+	c := &user{host: "db.example.com", server: s, sessions: []*muxSession{a}}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.listener = l
+	go s.serveTCP(c, l)
+	defer c.closeListener()
+
+	// the target replies after the request is fully read
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				b, _ := io.ReadAll(conn)
+				conn.Write(append([]byte("re: "), b...))
+			}()
+		}
+	}()
+
+	// the client side forwards to the target
+	go func() {
+		for peer := range accepts {
+			conn, err := net.Dial("tcp", target.Addr().String())
+			if err != nil {
+				peer.Close()
+				continue
+			}
+			go pipe(peer, conn)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite() error = %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if got, err := io.ReadAll(conn); err != nil || string(got) != "re: ping" {
+		t.Errorf("ReadAll() = %q, %v, want re: ping", got, err)
+	}
+}
+
+func Test_tcpForwarder_workers(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	a, _, accepts := newSessionPair(t)
+	f := newTCPForwarder(target.Addr().String(), 1)
+	go f.Serve(&listener{reqConns: accepts, done: make(chan struct{}), logger: f.logger})
+	defer f.Shutdown(context.Background())
+
+	echo := func(conn net.Conn, msg string) error {
+		conn.SetDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			return err
+		}
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			return err
+		}
+		if string(got) != msg {
+			return fmt.Errorf("received %q, want %q", got, msg)
+		}
+		return nil
+	}
+
+	first, err := a.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := echo(first, "first"); err != nil {
+		t.Fatalf("echo() error = %v", err)
+	}
+
+	// the second one waits for the worker, without blocking the first one
+	second, err := a.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.Write([]byte("second"))
+	for i := 0; i < 3; i++ {
+		if err := echo(first, fmt.Sprint("ping ", i)); err != nil {
+			t.Fatalf("echo() over the limit error = %v", err)
+		}
+	}
+
+	first.Close()
+	got := make([]byte, 6)
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(second, got); err != nil || string(got) != "second" {
+		t.Errorf("Read() = %q, %v, want second after the worker is free", got, err)
+	}
+}
@@ -0,0 +1,110 @@
+package hypro
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// clientHelloTimeout bounds how long to wait for the ClientHello of a
+// passthrough connection
+const clientHelloTimeout = 10 * time.Second
+
+var errClientHelloRead = errors.New("client hello read")
+
+// serveTLSPassthrough accepts tls connections and pipes them without
+// decrypting to the tunnel of the SNI, until l is closed
+func (s *Server) serveTLSPassthrough(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go s.passthrough(conn)
+	}
+}
+
+func (s *Server) passthrough(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	serverName, conn, err := peekServerName(conn)
+	if err != nil {
+		s.logger().Debug("could not read tls client hello", "remote_addr", conn.RemoteAddr(), "err", err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.waitTimeout())
+	tunnel, err := s.getIdleConn(ctx, serverName, ProtocolTLS)
+	cancel()
+	if err != nil {
+		s.logger().Warn("tunnel not found", "host", serverName, "err", err)
+		conn.Close()
+		return
+	}
+	pipe(conn, tunnel)
+}
+
+// peekServerName reads the SNI of the ClientHello, and returns the conn
+// to read from the beginning again
+func peekServerName(conn net.Conn) (string, net.Conn, error) {
+	var buf bytes.Buffer
+	var hello *tls.ClientHelloInfo
+	err := tls.Server(readOnlyConn{Conn: conn, r: io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = h
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+
+	conn = &peekedConn{Conn: conn, r: io.MultiReader(&buf, conn)}
+	if hello == nil {
+		return "", conn, errors.Wrap(err, "no client hello")
+	}
+	if hello.ServerName == "" {
+		return "", conn, errors.New("no server name")
+	}
+	return strings.ToLower(hello.ServerName), conn, nil
+}
+
+// readOnlyConn feeds the tls handshake the bytes read, and discards the writes
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c readOnlyConn) Write(b []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+func (c readOnlyConn) Close() error {
+	return nil
+}
+
+// peekedConn replays the peeked bytes before reading from the conn
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// CloseWrite closes the write side of the conn, or the conn if it could not
+func (c *peekedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,67 @@
+package hypro
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"testing"
+)
+
+func Test_peekServerName(t *testing.T) {
+	tests := []struct {
+		name       string
+		serverName string
+		want       string
+		wantErr    bool
+	}{
+		{"SNI", "Secure.Example.com", "secure.example.com", false},
+		{"No SNI", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c1, c2 := net.Pipe()
+			defer c1.Close()
+			go tls.Client(c1, &tls.Config{ServerName: tt.serverName, InsecureSkipVerify: true}).Handshake()
+
+			got, _, err := peekServerName(c2)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("peekServerName() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("peekServerName() = %v, want %v", got, tt.want)
+			}
+			c2.Close()
+		})
+	}
+}
+
+func TestServer_passthrough(t *testing.T) {
+	a, _, accepts := newSessionPair(t)
+	s := &Server{users: map[string]*user{}}
+	s.users["secure.example.com"] = &user{host: "secure.example.com", protocol: ProtocolTLS, server: s, sessions: []*muxSession{a}}
+
+	// the target behind the client terminates tls
+	cert := newTestCert(t, "secure.example.com")
+	go func() {
+		for peer := range accepts {
+			conn := tls.Server(peer, &tls.Config{Certificates: []tls.Certificate{*cert}})
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	c1, c2 := net.Pipe()
+	go s.passthrough(c2)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+	conn := tls.Client(c1, &tls.Config{ServerName: "secure.example.com", RootCAs: roots})
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "ping" {
+		t.Errorf("Read() = %q, %v, want ping", got, err)
+	}
+}
@@ -26,3 +26,18 @@ func generateRandomString(s int) (string, error) {
 	b, err := generateRandomBytes(s)
 	return base64.URLEncoding.EncodeToString(b), err
 }
+
+const labelLetters = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+// generateRandomLabel returns a securely generated random DNS label
+// of lowercase letters and digits.
+func generateRandomLabel(n int) (string, error) {
+	b, err := generateRandomBytes(n)
+	if err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = labelLetters[int(b[i])%len(labelLetters)]
+	}
+	return string(b), nil
+}
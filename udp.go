@@ -0,0 +1,180 @@
+package hypro
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// maxDatagramSize is the max size of a UDP datagram
+	maxDatagramSize = 64 * 1024
+
+	// udpPeerTimeout expires the peer of a udp tunnel without datagrams
+	udpPeerTimeout = 2 * time.Minute
+)
+
+// listenUDP listens on the requested port, or a free port in the range if zero
+func (s *Server) listenUDP(port int) (net.PacketConn, error) {
+	var pc net.PacketConn
+	err := s.listenPort("udp", port, func(addr string) (err error) {
+		pc, err = net.ListenPacket("udp", addr)
+		return
+	})
+	return pc, err
+}
+
+// serveUDP forwards the datagrams of the udp tunnel to the client with the
+// addresses of the peers, until pc is closed
+func (s *Server) serveUDP(c *user, pc net.PacketConn) {
+	logger := c.logger().With("addr", pc.LocalAddr())
+	logger.Info("udp tunnel started")
+	defer logger.Info("udp tunnel closed")
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		c.mu.RLock()
+		session := c.activeSession()
+		c.mu.RUnlock()
+		if session == nil {
+			// dropped until the client connects, as udp does
+			continue
+		}
+		if err := session.sendDatagram(addr.String(), buf[:n]); err != nil {
+			logger.Warn("could not send datagram", "remote_addr", addr, "err", err)
+		}
+	}
+}
+
+// writeDatagram sends the reply of the client to the peer addr
+func (c *user) writeDatagram(addr string, data []byte) {
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		c.logger().Warn("invalid datagram address", "remote_addr", addr)
+		return
+	}
+	c.mu.RLock()
+	pc := c.packetConn
+	c.mu.RUnlock()
+	if pc == nil {
+		return
+	}
+	if _, err := pc.WriteTo(data, net.UDPAddrFromAddrPort(ap)); err != nil {
+		c.logger().Warn("could not write datagram", "remote_addr", addr, "err", err)
+	}
+}
+
+// udpForwarder replays the datagrams of the tunnel to the target from a
+// socket per peer, so the replies of the target find their way back.
+// The peers are expired after timeout without datagrams
+type udpForwarder struct {
+	target  string
+	timeout time.Duration
+	logger  *slog.Logger
+
+	mu     sync.Mutex // protects peers and closed
+	peers  map[string]*udpPeer
+	closed bool
+	done   chan struct{}
+}
+
+type udpPeer struct {
+	conn net.Conn
+	// session is the tunnel the peer's latest datagram came from
+	session *muxSession
+}
+
+func newUDPForwarder(target string) *udpForwarder {
+	return &udpForwarder{
+		target:  target,
+		timeout: udpPeerTimeout,
+		logger:  slog.Default(),
+		peers:   map[string]*udpPeer{},
+		done:    make(chan struct{}),
+	}
+}
+
+// Serve waits until Shutdown, the datagrams come through forward instead
+// of the connections of l
+func (f *udpForwarder) Serve(l net.Listener) error {
+	<-f.done
+	return nil
+}
+
+// Shutdown closes the sockets of all the peers
+func (f *udpForwarder) Shutdown(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	close(f.done)
+	for addr, p := range f.peers {
+		p.conn.Close()
+		delete(f.peers, addr)
+	}
+	return nil
+}
+
+// forward sends the datagram of the peer addr to the target
+func (f *udpForwarder) forward(session *muxSession, addr string, data []byte) {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return
+	}
+	p := f.peers[addr]
+	if p == nil {
+		conn, err := net.Dial("udp", f.target)
+		if err != nil {
+			f.mu.Unlock()
+			f.logger.Error("could not dial target", "target", f.target, "err", err)
+			return
+		}
+		p = &udpPeer{conn: conn}
+		f.peers[addr] = p
+		go f.reply(addr, p)
+	}
+	p.session = session
+	f.mu.Unlock()
+
+	p.conn.SetReadDeadline(time.Now().Add(f.timeout))
+	if _, err := p.conn.Write(data); err != nil {
+		f.logger.Warn("could not write datagram", "target", f.target, "err", err)
+	}
+}
+
+// reply sends the datagrams of the target back to the peer addr, until
+// the peer expires
+func (f *udpForwarder) reply(addr string, p *udpPeer) {
+	defer func() {
+		f.mu.Lock()
+		if f.peers[addr] == p {
+			delete(f.peers, addr)
+		}
+		f.mu.Unlock()
+		p.conn.Close()
+	}()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := p.conn.Read(buf)
+		if err != nil {
+			return
+		}
+		p.conn.SetReadDeadline(time.Now().Add(f.timeout))
+		f.mu.Lock()
+		session := p.session
+		f.mu.Unlock()
+		if err := session.sendDatagram(addr, buf[:n]); err != nil {
+			f.logger.Warn("could not send datagram", "remote_addr", addr, "err", err)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package hypro
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	pb "github.com/chuangbo/hypro/protos"
+)
+
+func TestServer_serveUDP(t *testing.T) {
+	// the target echoes
+	target, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := target.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			target.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{}
+	c := &user{host: "game.example.com", protocol: ProtocolUDP, server: s, packetConn: pc}
+	f := newUDPForwarder(target.LocalAddr().String())
+	f.timeout = 100 * time.Millisecond
+	defer f.Shutdown(context.Background())
+
+	// the server and client sides of the tunnel
+	s2c, c2s := make(chan *pb.Packet, 64), make(chan *pb.Packet, 64)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	serverSession := newMuxSession(&chanStream{send: s2c, recv: c2s, ctx: ctx}, nil)
+	serverSession.onDatagram = c.writeDatagram
+	clientSession := newMuxSession(&chanStream{send: c2s, recv: s2c, ctx: ctx}, nil)
+	clientSession.onDatagram = func(addr string, data []byte) {
+		f.forward(clientSession, addr, data)
+	}
+	go serverSession.serve()
+	go clientSession.serve()
+	c.sessions = []*muxSession{serverSession}
+
+	go s.serveUDP(c, pc)
+	defer c.closeListener()
+
+	peers := make([]net.Conn, 2)
+	for i := range peers {
+		if peers[i], err = net.Dial("udp", pc.LocalAddr().String()); err != nil {
+			t.Fatal(err)
+		}
+		defer peers[i].Close()
+	}
+	for i, peer := range peers {
+		want := []byte{byte('a' + i)}
+		peer.Write(want)
+		peer.SetReadDeadline(time.Now().Add(time.Second))
+		got := make([]byte, 16)
+		n, err := peer.Read(got)
+		if err != nil || string(got[:n]) != string(want) {
+			t.Errorf("Read() = %q, %v, want %q", got[:n], err, want)
+		}
+	}
+
+	f.mu.Lock()
+	if got := len(f.peers); got != 2 {
+		t.Errorf("peers = %d, want 2", got)
+	}
+	f.mu.Unlock()
+
+	// the idle peers expire
+	time.Sleep(3 * f.timeout)
+	f.mu.Lock()
+	if got := len(f.peers); got != 0 {
+		t.Errorf("peers = %d after idle, want 0", got)
+	}
+	f.mu.Unlock()
+}
@@ -0,0 +1,102 @@
+package hypro
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// defaultUpgradeIdleTimeout closes the upgraded connections, e.g. WebSocket,
+// without any traffic
+const defaultUpgradeIdleTimeout = 10 * time.Minute
+
+// upgradeRoundTripper sends the Upgrade requests with the upgrade transport,
+// so the long-lived upgraded connections are kept out of the transport's pool
+type upgradeRoundTripper struct {
+	transport, upgrade http.RoundTripper
+}
+
+func (t *upgradeRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	if isUpgrade(r) {
+		return t.upgrade.RoundTrip(r)
+	}
+	return t.transport.RoundTrip(r)
+}
+
+// isUpgrade reports whether r asks to switch protocols
+func isUpgrade(r *http.Request) bool {
+	return httpguts.HeaderValuesContainsToken(r.Header["Connection"], "Upgrade") && r.Header.Get("Upgrade") != ""
+}
+
+// makeUpgradeTransport returns the transport dialing a new tunnel connection
+// for every Upgrade request, which closes after the idle timeout
+func (s *Server) makeUpgradeTransport() *http.Transport {
+	timeout := s.UpgradeIdleTimeout
+	if timeout <= 0 {
+		timeout = defaultUpgradeIdleTimeout
+	}
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := s.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return newIdleTimeoutConn(conn, timeout), nil
+		},
+		DisableKeepAlives:     true,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// idleTimeoutConn times out the reads once neither read nor write happened
+// within the timeout
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+	// active is the unix nano time of the last read or write
+	active atomic.Int64
+}
+
+func newIdleTimeoutConn(conn net.Conn, timeout time.Duration) *idleTimeoutConn {
+	c := &idleTimeoutConn{Conn: conn, timeout: timeout}
+	c.touch()
+	return c
+}
+
+func (c *idleTimeoutConn) touch() {
+	c.active.Store(time.Now().UnixNano())
+}
+
+// idle returns how long the conn has no traffic
+func (c *idleTimeoutConn) idle() time.Duration {
+	return time.Since(time.Unix(0, c.active.Load()))
+}
+
+func (c *idleTimeoutConn) Read(b []byte) (int, error) {
+	for {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout - c.idle()))
+		n, err := c.Conn.Read(b)
+		if n > 0 {
+			c.touch()
+		}
+		// the reads time out while writing only, wait again
+		if n == 0 && os.IsTimeout(err) && c.idle() < c.timeout {
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *idleTimeoutConn) Write(b []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
@@ -0,0 +1,142 @@
+package hypro
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// startTunnel starts a server and a client tunneling domain to the target
+// in-process, and returns the server
+func startTunnel(t *testing.T, domain, target string, configure func(s *Server)) *Server {
+	t.Helper()
+	s := &Server{
+		GRPCAddr: fmt.Sprintf("127.0.0.1:%d", freePort(t)),
+		HTTPAddr: fmt.Sprintf("127.0.0.1:%d", freePort(t)),
+	}
+	if configure != nil {
+		configure(s)
+	}
+	go s.ListenAndServe()
+	waitForListener(t, s.GRPCAddr)
+	waitForListener(t, s.HTTPAddr)
+
+	_, port, _ := net.SplitHostPort(s.GRPCAddr)
+	c := &Client{Server: "127.0.0.1", Domain: domain, Insecure: true}
+	fmt.Sscan(port, &c.ServerPort)
+	go c.DialAndServeReverseProxy(target)
+
+	for start := time.Now(); !s.TunnelExists(domain); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("tunnel %s not created", domain)
+		}
+	}
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		c.Shutdown(ctx)
+		s.Shutdown(ctx)
+	})
+	return s
+}
+
+// waitForListener waits until addr accepts connections
+func waitForListener(t *testing.T, addr string) {
+	t.Helper()
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("%s not listening: %v", addr, err)
+		}
+	}
+}
+
+// dialWebSocket opens a websocket to the tunnel of domain through the server
+func dialWebSocket(t *testing.T, httpAddr, domain string) *websocket.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", httpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := websocket.NewConfig("ws://"+domain+"/echo", "http://"+domain+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		t.Fatalf("websocket handshake error = %v", err)
+	}
+	return ws
+}
+
+func TestServer_upgrade(t *testing.T) {
+	target := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		io.Copy(ws, ws)
+	}))
+	defer target.Close()
+
+	const domain = "ws.localhost"
+	httpAddr := startTunnel(t, domain, target.URL, func(s *Server) {
+		s.UpgradeIdleTimeout = 300 * time.Millisecond
+	}).HTTPAddr
+
+	echo := func(ws *websocket.Conn, msg string) error {
+		if err := websocket.Message.Send(ws, msg); err != nil {
+			return err
+		}
+		var got string
+		if err := websocket.Message.Receive(ws, &got); err != nil {
+			return err
+		}
+		if got != msg {
+			return fmt.Errorf("received %q, want %q", got, msg)
+		}
+		return nil
+	}
+
+	t.Run("Echo", func(t *testing.T) {
+		conns := make([]*websocket.Conn, 20)
+		for i := range conns {
+			conns[i] = dialWebSocket(t, httpAddr, domain)
+			defer conns[i].Close()
+		}
+		// more upgraded connections than the idle pool holds stay open together
+		for i, ws := range conns {
+			if err := echo(ws, fmt.Sprint("hello ", i)); err != nil {
+				t.Errorf("echo() error = %v", err)
+			}
+		}
+	})
+
+	t.Run("Active beyond idle timeout", func(t *testing.T) {
+		ws := dialWebSocket(t, httpAddr, domain)
+		defer ws.Close()
+		for i := 0; i < 6; i++ {
+			if err := echo(ws, fmt.Sprint("ping ", i)); err != nil {
+				t.Fatalf("echo() error = %v", err)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	})
+
+	t.Run("Idle timeout", func(t *testing.T) {
+		ws := dialWebSocket(t, httpAddr, domain)
+		defer ws.Close()
+		ws.SetReadDeadline(time.Now().Add(3 * time.Second))
+		var got string
+		if err := websocket.Message.Receive(ws, &got); err != io.EOF {
+			t.Errorf("Receive() error = %v, want EOF", err)
+		}
+	})
+}